@@ -0,0 +1,54 @@
+package common
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryConfig Controls how connection attempts to the server are retried.
+// The delay between attempts starts at InitialDelay and is multiplied by
+// Multiplier after every failure up to MaxDelay. No more attempts are made
+// once MaxWait would be exceeded, a zero MaxWait disables retries
+type RetryConfig struct {
+	InitialDelay time.Duration `mapstructure:"initialDelay"`
+	MaxDelay     time.Duration `mapstructure:"maxDelay"`
+	Multiplier   float64       `mapstructure:"multiplier"`
+	MaxWait      time.Duration `mapstructure:"maxWait"`
+}
+
+// backoff Computes the delays between consecutive connection attempts.
+// Every delay is randomized between half and the whole exponential delay,
+// so agencies started together do not retry in lockstep
+type backoff struct {
+	config  RetryConfig
+	attempt int
+	random  *rand.Rand
+}
+
+func newBackoff(config RetryConfig) *backoff {
+	return &backoff{
+		config: config,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next Returns the delay to wait before the next attempt
+func (b *backoff) next() time.Duration {
+	multiplier := b.config.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(b.config.InitialDelay) * math.Pow(multiplier, float64(b.attempt))
+	if b.config.MaxDelay > 0 && delay > float64(b.config.MaxDelay) {
+		delay = float64(b.config.MaxDelay)
+	}
+	b.attempt++
+
+	half := time.Duration(delay / 2)
+	if half <= 0 {
+		return time.Duration(delay)
+	}
+	return half + time.Duration(b.random.Int63n(int64(half)+1))
+}
@@ -0,0 +1,40 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffGrowsExponentiallyWithJitter(t *testing.T) {
+	retry := newBackoff(RetryConfig{
+		InitialDelay: 100 * time.Millisecond,
+		MaxDelay:     time.Second,
+		Multiplier:   2,
+	})
+
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for _, delay := range expected {
+		next := retry.next()
+		assert.GreaterOrEqual(t, next, delay/2)
+		assert.LessOrEqual(t, next, delay)
+	}
+}
+
+func TestBackoffWithoutMultiplierKeepsDelay(t *testing.T) {
+	retry := newBackoff(RetryConfig{InitialDelay: 100 * time.Millisecond})
+
+	for i := 0; i < 5; i++ {
+		next := retry.next()
+		assert.GreaterOrEqual(t, next, 50*time.Millisecond)
+		assert.LessOrEqual(t, next, 100*time.Millisecond)
+	}
+}
@@ -0,0 +1,167 @@
+package common
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared/protocol"
+)
+
+// agencyFilePath Returns the path of the bets file of the given agency
+// inside dir, following the agency-<ID>.csv naming of the dataset
+func agencyFilePath(dir string, agency string) string {
+	return filepath.Join(dir, fmt.Sprintf("agency-%s.csv", agency))
+}
+
+// filePosition Position in a bets file right after a row: Line rows were
+// read and the next one starts at byte Offset
+type filePosition struct {
+	Line   int
+	Offset int64
+}
+
+// betReader Streams the bets of an agency file one row at a time, so the
+// whole file never has to be held in memory
+type betReader struct {
+	file   *os.File
+	reader *csv.Reader
+	agency string
+	// start Position the reader was opened at
+	start    filePosition
+	position filePosition
+}
+
+// newBetReader Opens the bets file of an agency to read it from the
+// given position, which must have been returned by a previous reader of
+// the same file. Every row is expected to hold first name, last name,
+// document, birthdate and number
+func newBetReader(path string, agency string, from filePosition) (*betReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if from.Offset > info.Size() {
+		file.Close()
+		return nil, fmt.Errorf("position %d beyond the end of %v", from.Offset, path)
+	}
+	if _, err := file.Seek(from.Offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 5
+	reader.ReuseRecord = true
+
+	return &betReader{file: file, reader: reader, agency: agency, start: from, position: from}, nil
+}
+
+// Next Returns the next bet of the file, or io.EOF once every row has been
+// read
+func (r *betReader) Next() (protocol.Bet, error) {
+	record, err := r.reader.Read()
+	if err != nil {
+		return protocol.Bet{}, err
+	}
+	r.position = filePosition{
+		Line:   r.position.Line + 1,
+		Offset: r.start.Offset + r.reader.InputOffset(),
+	}
+	return protocol.Bet{
+		Agency:    r.agency,
+		FirstName: record[0],
+		LastName:  record[1],
+		Document:  record[2],
+		Birthdate: record[3],
+		Number:    record[4],
+	}, nil
+}
+
+// Position Returns the position right after the last row returned by Next
+func (r *betReader) Position() filePosition {
+	return r.position
+}
+
+func (r *betReader) Close() error {
+	return r.file.Close()
+}
+
+// batchReader Groups the bets of a betReader into batches holding at most
+// maxAmount bets whose encoded size does not exceed protocol.MaxBatchSize.
+// A non positive maxAmount only bounds batches by size
+type batchReader struct {
+	bets      *betReader
+	maxAmount int
+	pending   *protocol.Bet
+	// pendingPosition Position right after the pending bet
+	pendingPosition filePosition
+	// position Position right after the last bet of the last batch
+	position filePosition
+}
+
+func newBatchReader(bets *betReader, maxAmount int) *batchReader {
+	return &batchReader{bets: bets, maxAmount: maxAmount, position: bets.Position()}
+}
+
+// Next Returns the next batch of bets, or io.EOF once every bet has been
+// read. A bet that does not fit in the current batch is kept for the next one
+func (b *batchReader) Next() ([]protocol.Bet, error) {
+	batch := make([]protocol.Bet, 0)
+	size := protocol.BatchSize(nil)
+
+	position := b.position
+
+	for b.maxAmount <= 0 || len(batch) < b.maxAmount {
+		bet, betPosition, err := b.nextBet()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		betSize := protocol.BetSize(bet)
+		if size+betSize > protocol.MaxBatchSize {
+			if len(batch) == 0 {
+				return nil, fmt.Errorf("bet %v does not fit in a batch", bet.Document)
+			}
+			b.pending = &bet
+			b.pendingPosition = betPosition
+			break
+		}
+		batch = append(batch, bet)
+		size += betSize
+		position = betPosition
+	}
+
+	if len(batch) == 0 {
+		return nil, io.EOF
+	}
+	b.position = position
+	return batch, nil
+}
+
+// Position Returns the position right after the last bet of the batch
+// returned by Next, where reading must resume once the batch is stored
+func (b *batchReader) Position() filePosition {
+	return b.position
+}
+
+func (b *batchReader) nextBet() (protocol.Bet, filePosition, error) {
+	if b.pending != nil {
+		bet := *b.pending
+		b.pending = nil
+		return bet, b.pendingPosition, nil
+	}
+	bet, err := b.bets.Next()
+	return bet, b.bets.Position(), err
+}
@@ -0,0 +1,91 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared/protocol"
+)
+
+// writeBetsWithNames Writes an agency file with a bet for every first name
+// and returns its path
+func writeBetsWithNames(t *testing.T, names []string) string {
+	var rows strings.Builder
+	for i, name := range names {
+		fmt.Fprintf(&rows, "%s,Apellido,%08d,1990-01-01,%d\n", name, 30000000+i, i)
+	}
+	path := filepath.Join(t.TempDir(), "agency-1.csv")
+	assert.Nil(t, os.WriteFile(path, []byte(rows.String()), 0644))
+	return path
+}
+
+func repeatName(name string, times int) []string {
+	names := make([]string, times)
+	for i := range names {
+		names[i] = name
+	}
+	return names
+}
+
+func TestBatchReaderBoundsBatchesByAmountAndSize(t *testing.T) {
+	// Two of these fit in a batch but not three
+	large := strings.Repeat("n", protocol.MaxBatchSize/3)
+
+	cases := map[string]struct {
+		names     []string
+		maxAmount int
+		// sizes Amount of bets of every batch returned
+		sizes []int
+	}{
+		"amount":             {names: repeatName("Nombre", 25), maxAmount: 10, sizes: []int{10, 10, 5}},
+		"exact amount":       {names: repeatName("Nombre", 20), maxAmount: 10, sizes: []int{10, 10}},
+		"size only":          {names: repeatName("Nombre", 25), maxAmount: 0, sizes: []int{25}},
+		"size":               {names: repeatName(large, 5), maxAmount: 10, sizes: []int{2, 2, 1}},
+		"size before amount": {names: append([]string{"Nombre"}, repeatName(large, 3)...), maxAmount: 4, sizes: []int{3, 1}},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			reader, err := newBetReader(writeBetsWithNames(t, c.names), testAgency, filePosition{})
+			assert.Nil(t, err)
+			defer reader.Close()
+			batches := newBatchReader(reader, c.maxAmount)
+
+			// Bets carried over to the next batch are neither lost nor
+			// repeated, and the position follows the last bet of each batch
+			var documents []string
+			for _, size := range c.sizes {
+				batch, err := batches.Next()
+				assert.Nil(t, err)
+				assert.Len(t, batch, size)
+				assert.LessOrEqual(t, protocol.BatchSize(batch), protocol.MaxBatchSize)
+				for _, bet := range batch {
+					documents = append(documents, bet.Document)
+				}
+				assert.Equal(t, len(documents), batches.Position().Line)
+			}
+			_, err = batches.Next()
+			assert.Equal(t, io.EOF, err)
+			assert.Equal(t, testDocuments(0, len(c.names)), documents)
+		})
+	}
+}
+
+func TestBatchReaderFailsOnBetLargerThanABatch(t *testing.T) {
+	names := []string{"Nombre", strings.Repeat("n", protocol.MaxBatchSize)}
+	reader, err := newBetReader(writeBetsWithNames(t, names), testAgency, filePosition{})
+	assert.Nil(t, err)
+	defer reader.Close()
+	batches := newBatchReader(reader, 10)
+
+	batch, err := batches.Next()
+	assert.Nil(t, err)
+	assert.Len(t, batch, 1)
+	_, err = batches.Next()
+	assert.ErrorContains(t, err, "does not fit in a batch")
+}
@@ -0,0 +1,56 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/afero"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+)
+
+// checkpoint Progress of an agency over its bets file. Every row up to
+// Line, which ends at byte Offset, was acknowledged by the server and Seq
+// is the sequence number of the batch holding the last of them
+type checkpoint struct {
+	Agency string `json:"agency"`
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Offset int64  `json:"offset"`
+	Seq    uint32 `json:"seq"`
+}
+
+func (c checkpoint) position() filePosition {
+	return filePosition{Line: c.Line, Offset: c.Offset}
+}
+
+// loadCheckpoint Reads the checkpoint stored at path. A missing file is
+// not an error, the zero checkpoint is returned with ok set to false
+func loadCheckpoint(path string) (cp checkpoint, ok bool, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return checkpoint{}, false, nil
+	}
+	if err != nil {
+		return checkpoint{}, false, err
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return checkpoint{}, false, fmt.Errorf("invalid checkpoint %v: %w", path, err)
+	}
+	if cp.Line < 0 || cp.Offset < 0 {
+		return checkpoint{}, false, fmt.Errorf("invalid checkpoint %v: negative position", path)
+	}
+	return cp, true, nil
+}
+
+// saveCheckpoint Replaces the checkpoint stored at path at once, so a
+// crash leaves either the old or the new one but never a partial file
+func saveCheckpoint(path string, cp checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return shared.ReplaceFile(afero.NewOsFs(), path, append(data, '\n'), 0644)
+}
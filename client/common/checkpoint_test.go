@@ -0,0 +1,93 @@
+package common
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpointIsReplacedAtomically(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+
+	_, ok, err := loadCheckpoint(path)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	first := checkpoint{Agency: "1", File: "agency-1.csv", Line: 10, Offset: 420, Seq: 2}
+	assert.Nil(t, saveCheckpoint(path, first))
+
+	// A crash while writing the next checkpoint leaves a partial temporary
+	// file behind, which does not affect the saved one
+	assert.Nil(t, os.WriteFile(path+".tmp", []byte(`{"agency":"1","li`), 0644))
+	loaded, ok, err := loadCheckpoint(path)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, first, loaded)
+
+	second := checkpoint{Agency: "1", File: "agency-1.csv", Line: 20, Offset: 840, Seq: 4}
+	assert.Nil(t, saveCheckpoint(path, second))
+	loaded, _, err = loadCheckpoint(path)
+	assert.Nil(t, err)
+	assert.Equal(t, second, loaded)
+}
+
+func TestLoadCheckpointRejectsCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+
+	assert.Nil(t, os.WriteFile(path, []byte("not json"), 0644))
+	_, _, err := loadCheckpoint(path)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, os.WriteFile(path, []byte(`{"line":-1,"offset":10}`), 0644))
+	_, _, err = loadCheckpoint(path)
+	assert.NotNil(t, err)
+}
+
+func TestBatchReaderResumesAfterLastBatch(t *testing.T) {
+	dir := t.TempDir()
+	writeTestBets(t, dir, 12)
+	path := agencyFilePath(dir, testAgency)
+
+	reader, err := newBetReader(path, testAgency, filePosition{})
+	assert.Nil(t, err)
+	batches := newBatchReader(reader, 5)
+	_, err = batches.Next()
+	assert.Nil(t, err)
+	position := batches.Position()
+	reader.Close()
+	assert.Equal(t, 5, position.Line)
+
+	reader, err = newBetReader(path, testAgency, position)
+	assert.Nil(t, err)
+	defer reader.Close()
+	batches = newBatchReader(reader, 5)
+
+	documents := []string{}
+	for {
+		batch, err := batches.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		for _, bet := range batch {
+			documents = append(documents, bet.Document)
+		}
+	}
+	assert.Equal(t, testDocuments(5, 12), documents)
+	assert.Equal(t, 12, batches.Position().Line)
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, info.Size(), batches.Position().Offset)
+}
+
+func TestBetReaderRejectsPositionBeyondEndOfFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestBets(t, dir, 2)
+
+	_, err := newBetReader(agencyFilePath(dir, testAgency), testAgency, filePosition{Line: 10, Offset: 1 << 20})
+	assert.NotNil(t, err)
+}
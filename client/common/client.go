@@ -1,40 +1,136 @@
 package common
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/op/go-logging"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared/protocol"
 )
 
 var log = logging.MustGetLogger("log")
 
 type ServerConfig struct {
-	Address string `mapstructure:"address"`
+	Address  string         `mapstructure:"address"`
+	Retry    RetryConfig    `mapstructure:"retry"`
+	Timeouts TimeoutsConfig `mapstructure:"timeouts"`
+	TLS      TLSConfig      `mapstructure:"tls"`
+}
+
+// TLSConfig Optional TLS for the connection with the server. The server
+// certificate is verified against CA, or the system roots if it is not
+// set, and must be issued to ServerName, which defaults to the host of
+// the server address. Cert and Key are presented to servers requiring a
+// client certificate
+type TLSConfig struct {
+	Enabled    bool   `mapstructure:"enabled"`
+	Cert       string `mapstructure:"cert"`
+	Key        string `mapstructure:"key"`
+	CA         string `mapstructure:"ca"`
+	ServerName string `mapstructure:"serverName"`
 }
 
-type LoopConfig struct {
-	Period time.Duration `mapstructure:"period"`
-	Amount int           `mapstructure:"amount"`
+// TimeoutsConfig Deadlines applied to the connection with the server. Read
+// bounds the wait for each reply and Write the send of each request. A
+// session left unused for longer than Idle is closed and reopened before
+// the next request, so it should be lower than the server idle timeout
+type TimeoutsConfig struct {
+	Read  time.Duration `mapstructure:"read"`
+	Write time.Duration `mapstructure:"write"`
+	Idle  time.Duration `mapstructure:"idle"`
 }
 
 type LogConfig struct {
 	Level string `mapstructure:"level"`
 }
 
+// DataConfig Directory holding the agency-<ID>.csv bets files, the working
+// directory if it is not set. The client submits every bet of its agency
+// file. Checkpoint, if set, is the file where the
+// progress over the agency file is recorded after every acknowledged
+// batch, so a restarted client resumes right after the last stored bet.
+// Batch.MaxAmount must not change while a checkpoint is kept, as the
+// batch in flight when the client died is resent with the same sequence
+type DataConfig struct {
+	Dir        string `mapstructure:"dir"`
+	Checkpoint string `mapstructure:"checkpoint"`
+}
+
+// BatchConfig Maximum amount of bets sent to the server in a single
+// message. Batches are also bounded by protocol.MaxBatchSize bytes
+type BatchConfig struct {
+	MaxAmount int `mapstructure:"maxAmount"`
+}
+
+// AuthConfig File holding the secret shared with the server, used to
+// authenticate the agency when opening a session. See shared.LoadKeys
+type AuthConfig struct {
+	KeysFile string `mapstructure:"keysFile"`
+}
+
 type Config struct {
 	ID     string       `mapstructure:"id"`
 	Server ServerConfig `mapstructure:"server"`
-	Loop   LoopConfig   `mapstructure:"loop"`
+	Auth   AuthConfig   `mapstructure:"auth"`
 	Log    LogConfig    `mapstructure:"log"`
+	Data   DataConfig   `mapstructure:"data"`
+	Batch  BatchConfig  `mapstructure:"batch"`
 }
 
+// ErrRejected Returned when the server replies to a request with an error
+var ErrRejected = errors.New("rejected by server")
+
+// ErrStopped Returned when a request is attempted after Stop was called
+var ErrStopped = errors.New("client stopped")
+
+// ErrSessionRejected Returned when the server refuses to open a session,
+// either because the agency is unknown or it failed to authenticate
+var ErrSessionRejected = errors.New("session rejected by server")
+
+// ErrServerUnreachable Returned when no session could be opened with the
+// server before the configured retry time ran out
+var ErrServerUnreachable = errors.New("server unreachable")
+
+// errHandshake Returned when the TLS handshake with the server fails
+var errHandshake = errors.New("tls handshake failed")
+
+const (
+	// winnersPollInterval Time waited between winners queries while the
+	// draw is pending
+	winnersPollInterval = time.Second
+	// maxRequestAttempts Times a request is sent, reopening the session in
+	// between, before giving up on it
+	maxRequestAttempts = 2
+)
+
 // Client Entity that encapsulates how
 type Client struct {
 	config Config
-	conn   net.Conn
+	// secret Shared with the server, read from Auth.KeysFile
+	secret []byte
+	// tlsConfig Used to connect to the server over TLS, nil when disabled
+	tlsConfig *tls.Config
+
+	// connLock Guards conn, which can be closed by Stop from another
+	// goroutine while a request is in progress
+	connLock sync.Mutex
+	conn     net.Conn
+	// lastUsed When the last reply was received on conn
+	lastUsed time.Time
+	// seq Sequence number of the last batch sent
+	seq uint32
+
+	// done Closed once Stop is called
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
 // NewClient Initializes a new client receiving the configuration
@@ -42,60 +138,602 @@ type Client struct {
 func NewClient(config Config) *Client {
 	client := &Client{
 		config: config,
+		done:   make(chan struct{}),
 	}
 	return client
 }
 
-// CreateClientSocket Initializes client socket. In case of
-// failure, error is printed in stdout/stderr and exit 1
-// is returned
-func (c *Client) createClientSocket() error {
-	conn, err := net.Dial("tcp", c.config.Server.Address)
+// Stop Makes the client stop sending new requests and closes its
+// connection, interrupting the request in progress if any. It is safe to
+// call it more than once and from any goroutine
+func (c *Client) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.done)
+		c.connLock.Lock()
+		defer c.connLock.Unlock()
+		if c.conn != nil {
+			c.conn.Close()
+		}
+	})
+}
+
+func (c *Client) stopped() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// CreateClientSocket Initializes client socket, making a single attempt
+// bounded by timeout, see dial
+func (c *Client) createClientSocket(timeout time.Duration) error {
+	conn, err := c.dial(timeout)
 	if err != nil {
-		log.Criticalf(
-			"action: connect | result: fail | client_id: %v | error: %v",
+		if c.stopped() {
+			return ErrStopped
+		}
+		return err
+	}
+	if c.tlsConfig != nil {
+		if conn, err = c.secureConnection(conn); err != nil {
+			log.Criticalf("action: tls_handshake | result: fail | client_id: %v | error: %v", c.config.ID, err)
+			return fmt.Errorf("%w: %v", errHandshake, err)
+		}
+	}
+
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	// Stop could have been called while dialing
+	if c.stopped() {
+		conn.Close()
+		return ErrStopped
+	}
+	c.conn = conn
+	return nil
+}
+
+// dial Connects to the server, giving up after timeout or as soon as the
+// client is stopped. Without time left, as when retries are disabled, the
+// write timeout bounds the attempt instead
+func (c *Client) dial(timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		timeout = c.config.Server.Timeouts.Write
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	dialer := net.Dialer{Timeout: timeout}
+	return dialer.DialContext(ctx, "tcp", c.config.Server.Address)
+}
+
+// secureConnection Runs the TLS handshake on a new connection, bounded by
+// the read timeout. The connection is closed if the handshake fails
+func (c *Client) secureConnection(conn net.Conn) (net.Conn, error) {
+	tlsConn := tls.Client(conn, c.tlsConfig)
+	if timeout := c.config.Server.Timeouts.Read; timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// loadTLSConfig Builds the TLS configuration of the connection with the
+// server when TLS is enabled
+func (c *Client) loadTLSConfig() error {
+	config := c.config.Server.TLS
+	if !config.Enabled {
+		return nil
+	}
+
+	serverName := config.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(c.config.Server.Address)
+		if err != nil {
+			return err
+		}
+		serverName = host
+	}
+
+	tlsConfig, err := shared.ClientTLSConfig(config.Cert, config.Key, config.CA, serverName)
+	if err != nil {
+		return err
+	}
+	c.tlsConfig = tlsConfig
+	return nil
+}
+
+// openSession Connects to the server and opens a session on behalf of the
+// agency. The session is kept open for every following request. Attempts
+// that fail to connect or get no answer, as when every slot of the server
+// is taken, are retried with exponential backoff as configured in
+// Server.Retry. Once the maximum wait is exceeded ErrServerUnreachable is
+// returned
+func (c *Client) openSession() error {
+	retry := newBackoff(c.config.Server.Retry)
+	start := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		err := c.startSession(c.config.Server.Retry.MaxWait - time.Since(start))
+		if err == nil {
+			log.Debugf("action: open_session | result: success | client_id: %v", c.config.ID)
+			return nil
+		}
+		// A rejected session or a failed handshake is caused by the
+		// credentials rather than by the server being unavailable
+		if errors.Is(err, ErrStopped) || errors.Is(err, ErrSessionRejected) || errors.Is(err, errHandshake) {
+			return err
+		}
+
+		delay := retry.next()
+		if time.Since(start)+delay > c.config.Server.Retry.MaxWait {
+			log.Criticalf(
+				"action: connect | result: fail | client_id: %v | attempts: %v | error: %v",
+				c.config.ID,
+				attempt,
+				err,
+			)
+			return fmt.Errorf("%w: %v", ErrServerUnreachable, err)
+		}
+
+		log.Warningf(
+			"action: connect | result: retry | client_id: %v | attempt: %v | delay: %v | error: %v",
 			c.config.ID,
+			attempt,
+			delay,
 			err,
 		)
+		select {
+		case <-time.After(delay):
+		case <-c.done:
+			return ErrStopped
+		}
+	}
+}
+
+// startSession Makes a single attempt at opening a session, connecting
+// within timeout and answering the challenge of the server
+func (c *Client) startSession(timeout time.Duration) error {
+	if err := c.createClientSocket(timeout); err != nil {
+		return err
+	}
+
+	hello, err := protocol.NewHelloMessage(c.config.ID)
+	var challenge protocol.Message
+	if err == nil {
+		challenge, err = c.exchange(hello)
+	}
+	if err == nil {
+		err = c.answerChallenge(challenge)
+	}
+	if err != nil {
+		c.closeClientSocket()
+		if c.stopped() {
+			return ErrStopped
+		}
+		if errors.Is(err, ErrRejected) {
+			log.Criticalf("action: auth | result: fail | client_id: %v | error: %v", c.config.ID, err)
+			// Not wrapping ErrRejected, so the whole submission stops
+			// instead of only the request that opened the session
+			return fmt.Errorf("%w: %v", ErrSessionRejected, err)
+		}
+		return err
 	}
-	c.conn = conn
 	return nil
 }
 
-// StartClientLoop Send messages to the client until some time threshold is met
-func (c *Client) StartClientLoop() {
-	// There is an autoincremental msgID to identify every message sent
-	// Messages if the message amount threshold has not been surpassed
-	for msgID := 1; msgID <= c.config.Loop.Amount; msgID++ {
-		// Create the connection the server in every loop iteration. Send an
-		c.createClientSocket()
+// answerChallenge Signs the nonce sent by the server with the agency
+// secret and waits for the server to accept it
+func (c *Client) answerChallenge(challenge protocol.Message) error {
+	nonce, err := protocol.DecodeChallenge(challenge)
+	if err != nil {
+		return err
+	}
+	auth, err := protocol.NewAuthMessage(protocol.SignChallenge(c.secret, c.config.ID, nonce))
+	if err != nil {
+		return err
+	}
+	reply, err := c.exchange(auth)
+	if err != nil {
+		return err
+	}
+	if reply.Type != protocol.MessageAck {
+		return fmt.Errorf("unexpected reply: %v", reply.Type)
+	}
+	return nil
+}
+
+// loadSecret Reads the secret of the agency from the keys file
+func (c *Client) loadSecret() error {
+	keys, err := shared.LoadKeys(c.config.Auth.KeysFile)
+	if err != nil {
+		return err
+	}
+	secret, ok := keys[c.config.ID]
+	if !ok {
+		return fmt.Errorf("no secret for agency %s", c.config.ID)
+	}
+	c.secret = secret
+	return nil
+}
+
+// closeSession Says goodbye to the server and closes the connection, if
+// a session is open
+func (c *Client) closeSession() {
+	if c.conn == nil {
+		return
+	}
+	shared.SendMessage(c.conn, protocol.NewGoodbyeMessage(), c.config.Server.Timeouts.Write)
+	c.closeClientSocket()
+}
 
-		// TODO: Modify the send to avoid short-write
-		fmt.Fprintf(
-			c.conn,
-			"[CLIENT %v] Message N°%v\n",
+// closeClientSocket Closes the current connection, if any
+func (c *Client) closeClientSocket() {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// StartClientLoop Submits every bet of the agency file to the server. Once
+// every bet was submitted the server is notified and the agency winners
+// are queried. ErrStopped is returned if the client was stopped before
+// finishing
+func (c *Client) StartClientLoop() error {
+	if err := c.loadSecret(); err != nil {
+		log.Criticalf("action: load_secret | result: fail | client_id: %v | file: %v | error: %v",
 			c.config.ID,
-			msgID,
+			c.config.Auth.KeysFile,
+			err,
 		)
-		msg, err := bufio.NewReader(c.conn).ReadString('\n')
-		c.conn.Close()
+		return err
+	}
+	if err := c.loadTLSConfig(); err != nil {
+		log.Criticalf("action: load_tls_config | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return err
+	}
+	defer c.closeSession()
+
+	if err := c.sendAgencyBets(); err != nil {
+		return err
+	}
+
+	if err := c.notifyBetsFinished(); err != nil {
+		log.Errorf("action: fin_apuestas | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return err
+	}
 
+	winners, err := c.queryWinners()
+	if err != nil {
+		if !c.stopped() {
+			log.Errorf("action: consulta_ganadores | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		}
+		return err
+	}
+	for _, winner := range winners {
+		log.Infof("action: ganador | result: success | dni: %v | premio: %v", winner.Document, winner.Tier)
+	}
+	log.Infof("action: consulta_ganadores | result: success | cant_ganadores: %v", len(winners))
+	return nil
+}
+
+// sendAgencyBets Streams the agency file submitting its bets in batches.
+// Bets rejected by the server are logged and skipped. A batch the server
+// could not take as a whole, like communication errors, stops the
+// submission without moving the checkpoint past it, so a restarted client
+// sends it again with the same sequence number
+func (c *Client) sendAgencyBets() error {
+	path := agencyFilePath(c.config.Data.Dir, c.config.ID)
+	progress, err := c.loadCheckpoint(path)
+	if err != nil {
+		log.Criticalf("action: load_checkpoint | result: fail | client_id: %v | file: %v | error: %v",
+			c.config.ID,
+			c.config.Data.Checkpoint,
+			err,
+		)
+		return err
+	}
+	c.seq = progress.Seq
+
+	reader, err := newBetReader(path, c.config.ID, progress.position())
+	if err != nil {
+		log.Criticalf("action: open_bets_file | result: fail | client_id: %v | file: %v | error: %v",
+			c.config.ID,
+			path,
+			err,
+		)
+		return err
+	}
+	defer reader.Close()
+
+	batches := newBatchReader(reader, c.config.Batch.MaxAmount)
+	sent, rejected := 0, 0
+	for !c.stopped() {
+		batch, err := batches.Next()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			log.Errorf("action: receive_message | result: fail | client_id: %v | error: %v",
+			log.Errorf("action: read_bets | result: fail | client_id: %v | error: %v", c.config.ID, err)
+			return err
+		}
+
+		rejections, err := c.submitBatch(batch)
+		if err != nil {
+			if c.stopped() {
+				break
+			}
+			log.Errorf("action: apuestas_enviadas | result: fail | client_id: %v | cantidad: %v | error: %v",
 				c.config.ID,
+				len(batch),
 				err,
 			)
-			return
+			return err
+		}
+
+		for _, rejection := range rejections {
+			bet := batch[rejection.Index]
+			log.Warningf("action: apuesta_enviada | result: fail | client_id: %v | dni: %v | numero: %v | motivo: %v",
+				c.config.ID,
+				bet.Document,
+				bet.Number,
+				rejection.Reason,
+			)
 		}
 
-		log.Infof("action: receive_message | result: success | client_id: %v | msg: %v",
+		log.Debugf("action: apuestas_enviadas | result: success | client_id: %v | cantidad: %v | rechazadas: %v",
 			c.config.ID,
-			msg,
+			len(batch)-len(rejections),
+			len(rejections),
 		)
+		sent += len(batch) - len(rejections)
+		rejected += len(rejections)
+		if err := c.saveCheckpoint(path, batches.Position()); err != nil {
+			return err
+		}
+	}
+
+	if c.stopped() {
+		log.Infof("action: apuestas_enviadas | result: interrupted | client_id: %v | cantidad: %v | rechazadas: %v",
+			c.config.ID,
+			sent,
+			rejected,
+		)
+		return ErrStopped
+	}
+
+	log.Infof("action: apuestas_enviadas | result: success | client_id: %v | cantidad: %v | rechazadas: %v",
+		c.config.ID,
+		sent,
+		rejected,
+	)
+	return nil
+}
+
+// loadCheckpoint Returns the progress recorded over the agency file at
+// path, or the zero checkpoint if there is none. A checkpoint recorded for
+// another agency or file is an error, starting over would reuse sequence
+// numbers the server already stored
+func (c *Client) loadCheckpoint(path string) (checkpoint, error) {
+	if c.config.Data.Checkpoint == "" {
+		return checkpoint{}, nil
+	}
+	progress, ok, err := loadCheckpoint(c.config.Data.Checkpoint)
+	if err != nil || !ok {
+		return checkpoint{}, err
+	}
+	if progress.Agency != c.config.ID || progress.File != path {
+		return checkpoint{}, fmt.Errorf("checkpoint belongs to agency %v file %v", progress.Agency, progress.File)
+	}
+
+	log.Infof("action: load_checkpoint | result: success | client_id: %v | linea: %v | seq: %v",
+		c.config.ID,
+		progress.Line,
+		progress.Seq,
+	)
+	return progress, nil
+}
+
+// saveCheckpoint Records that every bet of the agency file at path up to
+// position was acknowledged, the last of them in the batch numbered c.seq
+func (c *Client) saveCheckpoint(path string, position filePosition) error {
+	if c.config.Data.Checkpoint == "" {
+		return nil
+	}
+	err := saveCheckpoint(c.config.Data.Checkpoint, checkpoint{
+		Agency: c.config.ID,
+		File:   path,
+		Line:   position.Line,
+		Offset: position.Offset,
+		Seq:    c.seq,
+	})
+	if err != nil {
+		log.Errorf("action: save_checkpoint | result: fail | client_id: %v | file: %v | error: %v",
+			c.config.ID,
+			c.config.Data.Checkpoint,
+			err,
+		)
+	}
+	return err
+}
+
+// submitBatch Sends a batch of bets and waits for its confirmation,
+// returning the bets the server rejected. Every other bet of the batch
+// was stored. Each batch gets the next sequence number, kept when it is
+// resent so the server stores it only once
+func (c *Client) submitBatch(bets []protocol.Bet) ([]protocol.Rejection, error) {
+	c.seq++
+	msg, err := protocol.NewBetBatchMessage(c.seq, bets)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.request(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch reply.Type {
+	case protocol.MessageAck:
+		return nil, nil
+	case protocol.MessageBetsRejected:
+		rejections, err := protocol.DecodeBetsRejected(reply)
+		if err != nil {
+			return nil, err
+		}
+		for _, rejection := range rejections {
+			if rejection.Index < 0 || rejection.Index >= len(bets) {
+				return nil, fmt.Errorf("rejected bet out of batch: %d", rejection.Index)
+			}
+		}
+		return rejections, nil
+	default:
+		return nil, fmt.Errorf("unexpected reply: %v", reply.Type)
+	}
+}
 
-		// Wait a time between sending one message and the next one
-		time.Sleep(c.config.Loop.Period)
+// notifyBetsFinished Tells the server the agency has no more bets to submit
+func (c *Client) notifyBetsFinished() error {
+	msg, err := protocol.NewBetsFinishedMessage(c.config.ID)
+	if err != nil {
+		return err
+	}
+	return c.requestAck(msg)
+}
+
+// queryWinners Asks the server for the agency winners and the prize tier
+// each of them won. While the draw is pending the query is retried every
+// winnersPollInterval until it succeeds or the client is stopped
+func (c *Client) queryWinners() ([]protocol.Winner, error) {
+	msg, err := protocol.NewWinnersQueryMessage(c.config.ID)
+	if err != nil {
+		return nil, err
+	}
 
+	for {
+		reply, err := c.request(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		switch reply.Type {
+		case protocol.MessageWinners:
+			return protocol.DecodeWinners(reply)
+		case protocol.MessageDrawPending:
+			log.Debugf("action: consulta_ganadores | result: in_progress | client_id: %v", c.config.ID)
+		default:
+			return nil, fmt.Errorf("unexpected reply: %v", reply.Type)
+		}
+
+		select {
+		case <-time.After(winnersPollInterval):
+		case <-c.done:
+			return nil, ErrStopped
+		}
+	}
+}
+
+// requestAck Sends a request that the server must confirm with an ack
+func (c *Client) requestAck(msg protocol.Message) error {
+	reply, err := c.request(msg)
+	if err != nil {
+		return err
+	}
+	if reply.Type != protocol.MessageAck {
+		return fmt.Errorf("unexpected reply: %v", reply.Type)
+	}
+	return nil
+}
+
+// request Sends the message on the open session, opening one if needed,
+// and returns the reply. If the connection fails the session is reopened
+// and the message sent again, up to maxRequestAttempts times. An error
+// message from the server is returned as ErrRejected
+func (c *Client) request(msg protocol.Message) (protocol.Message, error) {
+	for attempt := 1; ; attempt++ {
+		if c.stopped() {
+			return protocol.Message{}, ErrStopped
+		}
+
+		if c.conn != nil && c.idle() {
+			log.Debugf("action: close_session | result: success | client_id: %v | msg: idle session", c.config.ID)
+			c.closeSession()
+		}
+		if c.conn == nil {
+			if err := c.openSession(); err != nil {
+				return protocol.Message{}, err
+			}
+		}
+
+		reply, err := c.exchange(msg)
+		if err == nil || errors.Is(err, ErrRejected) {
+			return reply, err
+		}
+
+		c.closeClientSocket()
+		if c.stopped() {
+			return protocol.Message{}, ErrStopped
+		}
+		if attempt == maxRequestAttempts {
+			return protocol.Message{}, err
+		}
+		c.logConnectionError(err)
+	}
+}
+
+// idle Reports whether the session went unused for longer than the idle
+// timeout, in which case the server may have already closed it
+func (c *Client) idle() bool {
+	idle := c.config.Server.Timeouts.Idle
+	return idle > 0 && time.Since(c.lastUsed) > idle
+}
+
+// logConnectionError Logs a failed request that is about to be retried,
+// telling apart a server that stopped responding from one that dropped
+// the connection
+func (c *Client) logConnectionError(err error) {
+	switch {
+	case shared.IsTimeout(err):
+		log.Warningf("action: reconnect | result: in_progress | client_id: %v | error: timeout", c.config.ID)
+	case shared.IsReset(err):
+		log.Warningf("action: reconnect | result: in_progress | client_id: %v | error: connection reset by peer", c.config.ID)
+	default:
+		log.Warningf("action: reconnect | result: in_progress | client_id: %v | error: %v", c.config.ID, err)
+	}
+}
+
+// exchange Sends the message on the current connection and waits for the
+// reply
+func (c *Client) exchange(msg protocol.Message) (protocol.Message, error) {
+	if err := shared.SendMessage(c.conn, msg, c.config.Server.Timeouts.Write); err != nil {
+		return protocol.Message{}, err
+	}
+
+	reply, err := shared.ReceiveMessage(c.conn, c.config.Server.Timeouts.Read)
+	if err != nil {
+		return protocol.Message{}, err
+	}
+	c.lastUsed = time.Now()
+
+	if reply.Type == protocol.MessageError {
+		reason, err := protocol.DecodeError(reply)
+		if err != nil {
+			return protocol.Message{}, err
+		}
+		return protocol.Message{}, fmt.Errorf("%w: %s", ErrRejected, reason)
 	}
-	log.Infof("action: loop_finished | result: success | client_id: %v", c.config.ID)
+	return reply, nil
 }
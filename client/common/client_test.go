@@ -0,0 +1,330 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared/protocol"
+)
+
+const testAgency = "1"
+
+// fakeServer Accepts sessions of any agency and stores the bet batches it
+// receives once per sequence number, like the real server does
+type fakeServer struct {
+	listener net.Listener
+
+	mu sync.Mutex
+	// received Sequence numbers of every batch received, resent ones too
+	received []uint32
+	stored   []protocol.Bet
+	lastSeq  uint32
+	// onBatch If set, called with every batch after storing it and before
+	// acknowledging it
+	onBatch func(seq uint32)
+	// failFrom If set, batches from this sequence number on are not stored
+	// and get an error reply, like a server whose store failed
+	failFrom uint32
+	// dropHellos Amount of sessions closed without answering their hello,
+	// like a server with every slot taken
+	dropHellos int
+}
+
+func startFakeServer(t *testing.T) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := &fakeServer{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		msg, err := shared.ReceiveMessage(conn, 5*time.Second)
+		if err != nil {
+			return
+		}
+
+		reply := protocol.NewAckMessage()
+		switch msg.Type {
+		case protocol.MessageHello:
+			if s.dropHello() {
+				return
+			}
+			reply, err = protocol.NewChallengeMessage(make([]byte, protocol.ChallengeSize))
+		case protocol.MessageBetBatch:
+			var seq uint32
+			var bets []protocol.Bet
+			seq, bets, err = protocol.DecodeBetBatch(msg)
+			if err == nil && !s.storeBatch(seq, bets) {
+				reply = protocol.NewErrorMessage("could not store bets")
+			}
+		case protocol.MessageWinnersQuery:
+			reply, err = protocol.NewWinnersMessage(nil)
+		case protocol.MessageGoodbye:
+			return
+		}
+		if err != nil {
+			return
+		}
+		if err := shared.SendMessage(conn, reply, 5*time.Second); err != nil {
+			return
+		}
+	}
+}
+
+// storeBatch Stores the batch unless it is a resent one, returning false
+// if it fails to
+func (s *fakeServer) storeBatch(seq uint32, bets []protocol.Bet) bool {
+	s.mu.Lock()
+	s.received = append(s.received, seq)
+	if s.failFrom > 0 && seq >= s.failFrom {
+		s.mu.Unlock()
+		return false
+	}
+	if seq > s.lastSeq {
+		s.stored = append(s.stored, bets...)
+		s.lastSeq = seq
+	}
+	onBatch := s.onBatch
+	s.mu.Unlock()
+
+	if onBatch != nil {
+		onBatch(seq)
+	}
+	return true
+}
+
+func (s *fakeServer) setOnBatch(onBatch func(seq uint32)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onBatch = onBatch
+}
+
+// dropHello Reports whether the hello being served must go unanswered
+func (s *fakeServer) dropHello() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dropHellos == 0 {
+		return false
+	}
+	s.dropHellos--
+	return true
+}
+
+func (s *fakeServer) setFailFrom(seq uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failFrom = seq
+}
+
+func (s *fakeServer) receivedSeqs() []uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint32(nil), s.received...)
+}
+
+func (s *fakeServer) storedDocuments() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	documents := make([]string, 0, len(s.stored))
+	for _, bet := range s.stored {
+		documents = append(documents, bet.Document)
+	}
+	return documents
+}
+
+// testDocuments Returns the documents of the bets written by writeTestBets
+func testDocuments(from int, to int) []string {
+	documents := make([]string, 0, to-from)
+	for i := from; i < to; i++ {
+		documents = append(documents, fmt.Sprintf("%08d", 30000000+i))
+	}
+	return documents
+}
+
+// writeTestBets Writes an agency file with the given amount of bets into
+// dir
+func writeTestBets(t *testing.T, dir string, amount int) {
+	var rows strings.Builder
+	for i, document := range testDocuments(0, amount) {
+		fmt.Fprintf(&rows, "Nombre %d,Apellido,%s,1990-01-01,%d\n", i, document, i)
+	}
+	path := agencyFilePath(dir, testAgency)
+	assert.Nil(t, os.WriteFile(path, []byte(rows.String()), 0644))
+}
+
+// testClientConfig Returns the configuration of a client of testAgency
+// sending a file of bets in batches of batchSize, keeping its checkpoint
+// in dir
+func testClientConfig(t *testing.T, server *fakeServer, dir string, batchSize int) Config {
+	keys := filepath.Join(dir, "keys.csv")
+	assert.Nil(t, os.WriteFile(keys, []byte(testAgency+",secret\n"), 0644))
+
+	return Config{
+		ID: testAgency,
+		Server: ServerConfig{
+			Address: server.listener.Addr().String(),
+			Retry: RetryConfig{
+				InitialDelay: 10 * time.Millisecond,
+				MaxDelay:     100 * time.Millisecond,
+				Multiplier:   2,
+				MaxWait:      time.Second,
+			},
+			Timeouts: TimeoutsConfig{Read: 5 * time.Second, Write: 5 * time.Second},
+		},
+		Auth:  AuthConfig{KeysFile: keys},
+		Data:  DataConfig{Dir: dir, Checkpoint: filepath.Join(dir, "checkpoint.json")},
+		Batch: BatchConfig{MaxAmount: batchSize},
+	}
+}
+
+func TestClientKilledMidFileResumesFromCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	writeTestBets(t, dir, 50)
+	server := startFakeServer(t)
+	config := testClientConfig(t, server, dir, 5)
+
+	// The first client dies once the fourth batch reached the server but
+	// before it was acknowledged
+	first := NewClient(config)
+	server.setOnBatch(func(seq uint32) {
+		if seq == 4 {
+			first.Stop()
+		}
+	})
+	assert.ErrorIs(t, first.StartClientLoop(), ErrStopped)
+
+	progress, ok, err := loadCheckpoint(config.Data.Checkpoint)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 15, progress.Line)
+	assert.Equal(t, uint32(3), progress.Seq)
+
+	server.setOnBatch(nil)
+	assert.Nil(t, NewClient(config).StartClientLoop())
+
+	// Only the unacknowledged batch is sent again, with its sequence
+	// number, so every bet is stored exactly once
+	assert.Equal(t, []uint32{1, 2, 3, 4, 4, 5, 6, 7, 8, 9, 10}, server.receivedSeqs())
+	assert.Equal(t, testDocuments(0, 50), server.storedDocuments())
+
+	progress, _, err = loadCheckpoint(config.Data.Checkpoint)
+	assert.Nil(t, err)
+	assert.Equal(t, 50, progress.Line)
+	assert.Equal(t, uint32(10), progress.Seq)
+}
+
+func TestClientKilledAtEveryBatchStoresEveryBetOnce(t *testing.T) {
+	dir := t.TempDir()
+	writeTestBets(t, dir, 23)
+	server := startFakeServer(t)
+	config := testClientConfig(t, server, dir, 4)
+
+	// Every client dies on the first new batch it sends, so each batch
+	// is only acknowledged after a restart
+	for restarts := 0; ; restarts++ {
+		assert.Less(t, restarts, 10)
+		client := NewClient(config)
+		acknowledged := uint32(restarts)
+		server.setOnBatch(func(seq uint32) {
+			if seq > acknowledged {
+				client.Stop()
+			}
+		})
+		if client.StartClientLoop() == nil {
+			break
+		}
+	}
+
+	assert.Equal(t, testDocuments(0, 23), server.storedDocuments())
+}
+
+func TestClientStopsWithoutCheckpointingBatchTheServerFailedToStore(t *testing.T) {
+	dir := t.TempDir()
+	writeTestBets(t, dir, 20)
+	server := startFakeServer(t)
+	config := testClientConfig(t, server, dir, 5)
+
+	server.setFailFrom(3)
+	assert.ErrorIs(t, NewClient(config).StartClientLoop(), ErrRejected)
+
+	// The failed batch is neither skipped nor followed by the next ones
+	progress, ok, err := loadCheckpoint(config.Data.Checkpoint)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 10, progress.Line)
+	assert.Equal(t, uint32(2), progress.Seq)
+	assert.Equal(t, []uint32{1, 2, 3}, server.receivedSeqs())
+
+	// Once the server recovers the batch is sent again with its sequence
+	// number
+	server.setFailFrom(0)
+	assert.Nil(t, NewClient(config).StartClientLoop())
+	assert.Equal(t, []uint32{1, 2, 3, 3, 4}, server.receivedSeqs())
+	assert.Equal(t, testDocuments(0, 20), server.storedDocuments())
+}
+
+func TestClientRetriesSessionsTheServerDoesNotAnswer(t *testing.T) {
+	dir := t.TempDir()
+	writeTestBets(t, dir, 5)
+	server := startFakeServer(t)
+	server.dropHellos = 2
+	config := testClientConfig(t, server, dir, 5)
+
+	assert.Nil(t, NewClient(config).StartClientLoop())
+	assert.Equal(t, testDocuments(0, 5), server.storedDocuments())
+}
+
+func TestClientGivesUpOnUnreachableServer(t *testing.T) {
+	dir := t.TempDir()
+	writeTestBets(t, dir, 5)
+	server := startFakeServer(t)
+	config := testClientConfig(t, server, dir, 5)
+	config.Server.Retry.MaxWait = 200 * time.Millisecond
+
+	// Nothing listens on the port once the server is closed
+	server.listener.Close()
+	start := time.Now()
+	assert.ErrorIs(t, NewClient(config).StartClientLoop(), ErrServerUnreachable)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestClientRefusesCheckpointOfAnotherAgency(t *testing.T) {
+	dir := t.TempDir()
+	writeTestBets(t, dir, 10)
+	server := startFakeServer(t)
+	config := testClientConfig(t, server, dir, 5)
+
+	err := saveCheckpoint(config.Data.Checkpoint, checkpoint{
+		Agency: "2",
+		File:   agencyFilePath(dir, "2"),
+		Line:   5,
+		Offset: 100,
+		Seq:    1,
+	})
+	assert.Nil(t, err)
+
+	assert.NotNil(t, NewClient(config).StartClientLoop())
+	assert.Empty(t, server.storedDocuments())
+}
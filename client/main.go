@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/op/go-logging"
 	"github.com/pkg/errors"
@@ -24,9 +25,23 @@ func InitConfig() (*common.Config, error) {
 	// Configure viper to read env variables with the CLI_ prefix
 	v.BindEnv("id", "CLI_ID")
 	v.BindEnv("server.address", "CLI_SERVER_ADDRESS")
-	v.BindEnv("loop.period", "CLI_LOOP_PERIOD")
-	v.BindEnv("loop.amount", "CLI_LOOP_AMOUNT")
+	v.BindEnv("server.retry.initialDelay", "CLI_SERVER_RETRY_INITIALDELAY")
+	v.BindEnv("server.retry.maxDelay", "CLI_SERVER_RETRY_MAXDELAY")
+	v.BindEnv("server.retry.multiplier", "CLI_SERVER_RETRY_MULTIPLIER")
+	v.BindEnv("server.retry.maxWait", "CLI_SERVER_RETRY_MAXWAIT")
+	v.BindEnv("server.timeouts.read", "CLI_SERVER_TIMEOUTS_READ")
+	v.BindEnv("server.timeouts.write", "CLI_SERVER_TIMEOUTS_WRITE")
+	v.BindEnv("server.timeouts.idle", "CLI_SERVER_TIMEOUTS_IDLE")
+	v.BindEnv("server.tls.enabled", "CLI_SERVER_TLS_ENABLED")
+	v.BindEnv("server.tls.cert", "CLI_SERVER_TLS_CERT")
+	v.BindEnv("server.tls.key", "CLI_SERVER_TLS_KEY")
+	v.BindEnv("server.tls.ca", "CLI_SERVER_TLS_CA")
+	v.BindEnv("server.tls.serverName", "CLI_SERVER_TLS_SERVERNAME")
+	v.BindEnv("auth.keysFile", "CLI_AUTH_KEYSFILE")
 	v.BindEnv("log.level", "CLI_LOG_LEVEL")
+	v.BindEnv("data.dir", "CLI_DATA_DIR")
+	v.BindEnv("data.checkpoint", "CLI_DATA_CHECKPOINT")
+	v.BindEnv("batch.maxAmount", "CLI_BATCH_MAXAMOUNT")
 
 	v.SetConfigFile("./config.yaml")
 	if err := v.ReadInConfig(); err != nil {
@@ -35,7 +50,7 @@ func InitConfig() (*common.Config, error) {
 
 	config := common.Config{}
 	if err := v.Unmarshal(&config); err != nil {
-		return nil, errors.Wrapf(err, "Could not parse CLI_LOOP_PERIOD env var as time.Duration.")
+		return nil, errors.Wrapf(err, "Could not parse configuration.")
 	}
 
 	return &config, nil
@@ -44,11 +59,18 @@ func InitConfig() (*common.Config, error) {
 // PrintConfig Print all the configuration parameters of the program.
 // For debugging purposes only
 func PrintConfig(config *common.Config) {
-	log.Infof("action: config | result: success | client_id: %s | server_address: %s | loop_amount: %v | loop_period: %v | log_level: %s",
+	log.Infof("action: config | result: success | client_id: %s | server_address: %s | retry_max_wait: %v | read_timeout: %v | write_timeout: %v | idle_timeout: %v | tls_enabled: %v | keys_file: %s | data_dir: %s | checkpoint: %s | batch_max_amount: %v | log_level: %s",
 		config.ID,
 		config.Server.Address,
-		config.Loop.Amount,
-		config.Loop.Period,
+		config.Server.Retry.MaxWait,
+		config.Server.Timeouts.Read,
+		config.Server.Timeouts.Write,
+		config.Server.Timeouts.Idle,
+		config.Server.TLS.Enabled,
+		config.Auth.KeysFile,
+		config.Data.Dir,
+		config.Data.Checkpoint,
+		config.Batch.MaxAmount,
 		config.Log.Level,
 	)
 }
@@ -67,5 +89,19 @@ func main() {
 	PrintConfig(config)
 
 	client := common.NewClient(*config)
-	client.StartClientLoop()
+
+	stopSignals := shared.NotifyShutdown(func(sig os.Signal) {
+		log.Infof("action: signal_received | result: success | client_id: %s | signal: %v", config.ID, sig)
+		client.Stop()
+	})
+
+	err = client.StartClientLoop()
+	stopSignals()
+	log.Infof("action: shutdown | result: success | client_id: %s", config.ID)
+
+	// Exit with an error code unless every bet was submitted or the client
+	// was asked to stop
+	if err != nil && !errors.Is(err, common.ErrStopped) {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,107 @@
+// compose-gen Generates a docker compose file with the server and the
+// requested amount of agency clients.
+//
+// Usage: compose-gen <output file> <clients>
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"text/template"
+)
+
+const composeTemplate = `name: tp0
+services:
+  server:
+    container_name: server
+    image: server:latest
+    entrypoint: /server
+    environment:
+      - LOGGING_LEVEL=DEBUG
+      - SERVER_PORT=8080
+      - AGENCIES_AMOUNT={{ len .Clients }}
+      - SERVER_MAX_CLIENTS={{ .MaxClients }}
+    volumes:
+      - ./.data/keys.csv:/keys.csv
+    networks:
+      - testing_net
+{{ range .Clients }}
+  client{{ . }}:
+    container_name: client{{ . }}
+    image: client:latest
+    entrypoint: /client
+    environment:
+      - CLI_ID={{ . }}
+      - CLI_LOG_LEVEL=DEBUG
+      - CLI_SERVER_ADDRESS=server:8080
+      - CLI_DATA_DIR=/data
+    volumes:
+      - ./client/config.yaml:/config.yaml
+      - ./.data/keys-{{ . }}.csv:/keys.csv
+      - ./.data/agency-{{ . }}.csv:/data/agency-{{ . }}.csv
+    networks:
+      - testing_net
+    depends_on:
+      - server
+{{ end }}
+networks:
+  testing_net:
+    ipam:
+      driver: default
+      config:
+        - subnet: 172.25.125.0/24
+`
+
+var compose = template.Must(template.New("compose").Parse(composeTemplate))
+
+// generateCompose Renders the compose file for the given amount of clients,
+// numbered from 1 to clients
+func generateCompose(clients int) ([]byte, error) {
+	if clients < 1 {
+		return nil, fmt.Errorf("clients must be a positive number, got %d", clients)
+	}
+
+	ids := make([]int, 0, clients)
+	for id := 1; id <= clients; id++ {
+		ids = append(ids, id)
+	}
+
+	// Twice the agencies, so a client reconnecting gets a slot while the
+	// server still holds the one of its dropped connection
+	params := struct {
+		Clients    []int
+		MaxClients int
+	}{ids, 2 * clients}
+
+	buf := bytes.Buffer{}
+	if err := compose.Execute(&buf, params); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Fprintf(os.Stderr, "usage: %s <output file> <clients>\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	clients, err := strconv.Atoi(os.Args[2])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid clients amount %q: %v\n", os.Args[2], err)
+		os.Exit(2)
+	}
+
+	content, err := generateCompose(clients)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not generate compose file: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := os.WriteFile(os.Args[1], content, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
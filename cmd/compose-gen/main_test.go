@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func TestGenerateComposeMatchesGoldenFiles(t *testing.T) {
+	for _, clients := range []int{1, 3, 5} {
+		t.Run(fmt.Sprintf("%d clients", clients), func(t *testing.T) {
+			content, err := generateCompose(clients)
+			assert.Nil(t, err)
+
+			golden := filepath.Join("testdata", fmt.Sprintf("compose-%d.golden.yaml", clients))
+			if *update {
+				assert.Nil(t, os.WriteFile(golden, content, 0644))
+			}
+
+			expected, err := os.ReadFile(golden)
+			assert.Nil(t, err)
+			assert.Equal(t, string(expected), string(content))
+
+			parsed := struct {
+				Services map[string]interface{} `yaml:"services"`
+			}{}
+			assert.Nil(t, yaml.Unmarshal(content, &parsed))
+			assert.Len(t, parsed.Services, clients+1)
+		})
+	}
+}
+
+func TestGenerateComposeWithoutClientsMustFail(t *testing.T) {
+	_, err := generateCompose(0)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,99 @@
+// gencerts Creates a local certificate authority along with the
+// certificates of the server and of every agency, so mutual TLS can be
+// tested entirely offline. Agency certificates are issued to the agency ID
+// as common name, which the server checks against the agency of the
+// session.
+//
+// Usage: gencerts <output dir> <agencies> [server hosts...]
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared/certs"
+)
+
+// validity How long the generated certificates are valid for
+const validity = 365 * 24 * time.Hour
+
+// defaultHosts Names the server certificate is issued for when none are
+// given, covering the compose service and local runs
+var defaultHosts = []string{"server", "localhost", "127.0.0.1"}
+
+// generateCerts Writes ca.pem, server.pem and agency-<ID>.pem for agencies
+// 1 to agencies into dir, each certificate next to its -key.pem file
+func generateCerts(dir string, agencies int, hosts []string) error {
+	if agencies < 1 {
+		return fmt.Errorf("agencies must be a positive number, got %d", agencies)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	ca, err := certs.NewAuthority("tp0 lottery CA", validity)
+	if err != nil {
+		return err
+	}
+	caKey, err := ca.KeyPEM()
+	if err != nil {
+		return err
+	}
+	if err := writePair(dir, "ca", ca.CertPEM(), caKey); err != nil {
+		return err
+	}
+
+	cert, key, err := ca.IssueServer("server", hosts, validity)
+	if err != nil {
+		return err
+	}
+	if err := writePair(dir, "server", cert, key); err != nil {
+		return err
+	}
+
+	for agency := 1; agency <= agencies; agency++ {
+		cert, key, err := ca.IssueClient(strconv.Itoa(agency), validity)
+		if err != nil {
+			return err
+		}
+		if err := writePair(dir, fmt.Sprintf("agency-%d", agency), cert, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePair Writes <name>.pem and <name>-key.pem, keeping the key only
+// readable by its owner
+func writePair(dir string, name string, cert []byte, key []byte) error {
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), cert, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name+"-key.pem"), key, 0600)
+}
+
+func main() {
+	if len(os.Args) < 3 {
+		fmt.Fprintf(os.Stderr, "usage: %s <output dir> <agencies> [server hosts...]\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	agencies, err := strconv.Atoi(os.Args[2])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid agencies amount %q: %v\n", os.Args[2], err)
+		os.Exit(2)
+	}
+
+	hosts := defaultHosts
+	if len(os.Args) > 3 {
+		hosts = os.Args[3:]
+	}
+
+	if err := generateCerts(os.Args[1], agencies, hosts); err != nil {
+		fmt.Fprintf(os.Stderr, "could not generate certificates: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+)
+
+// handshake Runs a TLS handshake over a loopback connection, returning the
+// errors seen by each side and the client certificates the server got
+func handshake(t *testing.T, serverConfig *tls.Config, clientConfig *tls.Config) (error, error, []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	type result struct {
+		err   error
+		peers []string
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		server := tls.Server(conn, serverConfig)
+		err = server.Handshake()
+		peers := make([]string, 0)
+		for _, cert := range server.ConnectionState().PeerCertificates {
+			peers = append(peers, cert.Subject.CommonName)
+		}
+		accepted <- result{err: err, peers: peers}
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+	if err == nil {
+		// With TLS 1.3 the client may finish before the server verified
+		// its certificate, a read surfaces the server verdict
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	server := <-accepted
+	return err, server.err, server.peers
+}
+
+func TestGeneratedCertsEnableMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, generateCerts(dir, 2, []string{"server", "127.0.0.1"}))
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	serverConfig, err := shared.ServerTLSConfig(path("server.pem"), path("server-key.pem"), path("ca.pem"), true)
+	assert.Nil(t, err)
+
+	clientConfig, err := shared.ClientTLSConfig(path("agency-2.pem"), path("agency-2-key.pem"), path("ca.pem"), "server")
+	assert.Nil(t, err)
+	clientErr, serverErr, peers := handshake(t, serverConfig, clientConfig)
+	assert.Nil(t, clientErr)
+	assert.Nil(t, serverErr)
+	assert.Equal(t, []string{"2"}, peers)
+
+	// Without a certificate the client must be turned away
+	anonymous, err := shared.ClientTLSConfig("", "", path("ca.pem"), "127.0.0.1")
+	assert.Nil(t, err)
+	_, serverErr, _ = handshake(t, serverConfig, anonymous)
+	assert.NotNil(t, serverErr)
+}
+
+func TestServerCertIsRejectedByClientsTrustingOtherCA(t *testing.T) {
+	dir, other := t.TempDir(), t.TempDir()
+	assert.Nil(t, generateCerts(dir, 1, defaultHosts))
+	assert.Nil(t, generateCerts(other, 1, defaultHosts))
+
+	serverConfig, err := shared.ServerTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), "", false)
+	assert.Nil(t, err)
+	clientConfig, err := shared.ClientTLSConfig("", "", filepath.Join(other, "ca.pem"), "server")
+	assert.Nil(t, err)
+
+	clientErr, _, _ := handshake(t, serverConfig, clientConfig)
+	assert.NotNil(t, clientErr)
+}
+
+func TestGenerateCertsRejectsNonPositiveAgencies(t *testing.T) {
+	assert.NotNil(t, generateCerts(t.TempDir(), 0, defaultHosts))
+}
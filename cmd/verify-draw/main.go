@@ -0,0 +1,60 @@
+// verify-draw Recomputes a draw from the bets store it was drawn from and
+// checks it against the draw record written by the server: the revealed
+// seed must match the commitment, the store must pass verify-store and
+// hold the bets the draw took, and the winning number must be the one
+// derived from the seed and those bets. The commitment the server logged
+// before taking bets can be given to check it is the one recorded. The
+// exit status is 1 if the draw does not verify.
+//
+// Usage: verify-draw [-type csv|log] [-commitment hex] <draw record> <store path>
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/afero"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/common"
+)
+
+// run Verifies the draw named by args, writing the outcome to stdout and
+// stderr. Returns the exit status
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("verify-draw", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	kind := flags.String("type", common.StorageCSV, "storage type of the store, csv or log")
+	commitment := flags.String("commitment", "", "commitment published before the draw, checked against the record")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		fmt.Fprintln(stderr, "usage: verify-draw [-type csv|log] [-commitment hex] <draw record> <store path>")
+		return 2
+	}
+	recordPath, storePath := flags.Arg(0), flags.Arg(1)
+
+	fs := afero.NewOsFs()
+	draw, err := common.ReadDraw(fs, recordPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "could not verify %s: %v\n", recordPath, err)
+		return 1
+	}
+	if *commitment != "" && *commitment != draw.Commitment {
+		fmt.Fprintf(stderr, "%s: draw was committed to %s, not to %s\n", recordPath, draw.Commitment, *commitment)
+		return 1
+	}
+	if err := common.VerifyDraw(draw, fs, *kind, storePath); err != nil {
+		fmt.Fprintf(stderr, "%s: draw does not verify against %s: %v\n", recordPath, storePath, err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "%s: winning number %d verified over %d bets\n", recordPath, draw.Number, draw.Bets)
+	return 0
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/common"
+)
+
+// writeDraw Stores 5 bets in a new store of the kind and draws among them,
+// returning the paths of the draw record and of the store along with the
+// draw
+func writeDraw(t *testing.T, kind string) (string, string, *common.Draw) {
+	dir := t.TempDir()
+	storePath := filepath.Join(dir, "bets")
+	recordPath := filepath.Join(dir, "draw.json")
+	fs := afero.NewOsFs()
+
+	store, err := common.NewBetStore(fs, kind, storePath)
+	assert.Nil(t, err)
+	defer store.Close()
+	var bets []*common.Bet
+	for i := 0; i < 5; i++ {
+		bet, err := common.NewBet("1", "first", "last", fmt.Sprint(10000000+i), "2000-12-20", fmt.Sprint(i))
+		assert.Nil(t, err)
+		bets = append(bets, bet)
+	}
+	assert.Nil(t, common.StoreBets(store, bets))
+
+	prizes, err := common.ParsePrizeTiers("exact:4,last2:2")
+	assert.Nil(t, err)
+	draw, err := common.NewDraw(bytes.Repeat([]byte{7}, 32), store, prizes)
+	assert.Nil(t, err)
+	assert.Nil(t, common.WriteDraw(fs, recordPath, draw))
+	return recordPath, storePath, draw
+}
+
+func TestRunVerifiesRecordedDraws(t *testing.T) {
+	for _, kind := range []string{common.StorageCSV, common.StorageLog} {
+		recordPath, storePath, draw := writeDraw(t, kind)
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+
+		status := run([]string{"-type", kind, "-commitment", draw.Commitment, recordPath, storePath}, stdout, stderr)
+		assert.Equal(t, 0, status, stderr.String())
+		assert.Contains(t, stdout.String(), fmt.Sprintf("winning number %d verified over 5 bets", draw.Number))
+	}
+}
+
+func TestRunRejectsAnotherCommitment(t *testing.T) {
+	recordPath, storePath, _ := writeDraw(t, common.StorageCSV)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+
+	status := run([]string{"-commitment", strings.Repeat("0", 64), recordPath, storePath}, stdout, stderr)
+	assert.Equal(t, 1, status)
+	assert.Contains(t, stderr.String(), "was committed to")
+}
+
+func TestRunRejectsAlteredNumber(t *testing.T) {
+	recordPath, storePath, draw := writeDraw(t, common.StorageCSV)
+	draw.Number = (draw.Number + 1) % 10000
+	assert.Nil(t, os.Remove(recordPath))
+	assert.Nil(t, common.WriteDraw(afero.NewOsFs(), recordPath, draw))
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+
+	assert.Equal(t, 1, run([]string{recordPath, storePath}, stdout, stderr))
+	assert.Contains(t, stderr.String(), "winning number is")
+	assert.Empty(t, stdout.String())
+}
+
+func TestRunRejectsTamperedStore(t *testing.T) {
+	recordPath, storePath, _ := writeDraw(t, common.StorageCSV)
+	content, err := os.ReadFile(storePath)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(storePath, bytes.Replace(content, []byte("10000002"), []byte("10000009"), 1), 0644))
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+
+	assert.Equal(t, 1, run([]string{recordPath, storePath}, stdout, stderr))
+	assert.Contains(t, stderr.String(), "line 3")
+}
+
+func TestRunRequiresRecordAndStore(t *testing.T) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	assert.Equal(t, 2, run([]string{"draw.json"}, stdout, stderr))
+	assert.Contains(t, stderr.String(), "usage")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/common"
+)
+
+// writeStore Stores 5 bets in a new store of the kind, returning its path
+func writeStore(t *testing.T, kind string) string {
+	path := filepath.Join(t.TempDir(), "bets")
+	store, err := common.NewBetStore(afero.NewOsFs(), kind, path)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	var bets []*common.Bet
+	for i := 0; i < 5; i++ {
+		bet, err := common.NewBet("1", "first", "last", fmt.Sprint(10000000+i), "2000-12-20", fmt.Sprint(i))
+		assert.Nil(t, err)
+		bets = append(bets, bet)
+	}
+	assert.Nil(t, common.StoreBets(store, bets))
+	return path
+}
+
+func TestRunAcceptsUntouchedStores(t *testing.T) {
+	for _, kind := range []string{common.StorageCSV, common.StorageLog} {
+		path := writeStore(t, kind)
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+
+		assert.Equal(t, 0, run([]string{"-type", kind, path}, stdout, stderr), stderr.String())
+		assert.Contains(t, stdout.String(), "5 bets verified")
+	}
+}
+
+func TestRunReportsLineOfTamperedRow(t *testing.T) {
+	path := writeStore(t, common.StorageCSV)
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	tampered := strings.Replace(string(content), "10000003", "10000009", 1)
+	assert.Nil(t, os.WriteFile(path, []byte(tampered), 0644))
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+
+	assert.Equal(t, 1, run([]string{path}, stdout, stderr))
+	assert.Contains(t, stderr.String(), "line 4")
+	assert.Contains(t, stderr.String(), "3 valid bets before it")
+	assert.Empty(t, stdout.String())
+}
+
+func TestRunFailsOnMissingStore(t *testing.T) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	assert.Equal(t, 1, run([]string{filepath.Join(t.TempDir(), "missing")}, stdout, stderr))
+}
+
+func TestRunRequiresPath(t *testing.T) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	assert.Equal(t, 2, run(nil, stdout, stderr))
+	assert.Contains(t, stderr.String(), "usage")
+}
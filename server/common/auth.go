@@ -0,0 +1,104 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared/protocol"
+)
+
+var (
+	ErrAuthFailed     = errors.New("authentication failed")
+	ErrAgencyMismatch = errors.New("agency does not match the session")
+)
+
+// loadAgencyKeys Reads the secret of every expected agency from the keys
+// file. Rows of agencies outside the roster are ignored, while a missing
+// secret is an error since that agency could never open a session
+func loadAgencyKeys(path string, agencies []int) (map[int][]byte, error) {
+	keys, err := shared.LoadKeys(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not load agency keys: %v", err)
+	}
+
+	agencyKeys := make(map[int][]byte, len(agencies))
+	for _, agency := range agencies {
+		secret, ok := keys[strconv.Itoa(agency)]
+		if !ok {
+			return nil, fmt.Errorf("no secret for agency %d in %s", agency, path)
+		}
+		agencyKeys[agency] = secret
+	}
+	return agencyKeys, nil
+}
+
+// authenticate Challenges the peer that said hello as agency to prove it
+// knows the agency secret. A fresh random nonce is sent and the peer must
+// answer with its HMAC, which is compared against the one computed with
+// the secret from the keys file
+func (s *Server) authenticate(clientSocket net.Conn, agency int) error {
+	secret, ok := s.keys[agency]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownAgency, agency)
+	}
+
+	nonce := make([]byte, protocol.ChallengeSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	challenge, err := protocol.NewChallengeMessage(nonce)
+	if err != nil {
+		return err
+	}
+	if err := shared.SendMessage(clientSocket, challenge, s.writeTimeout); err != nil {
+		return err
+	}
+
+	msg, err := shared.ReceiveMessage(clientSocket, s.readTimeout)
+	if err != nil {
+		return err
+	}
+	signature, err := protocol.DecodeAuth(msg)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrAuthFailed, err)
+	}
+	if !protocol.VerifyChallenge(secret, strconv.Itoa(agency), nonce, signature) {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+// verifyPeerAgency Checks that the client certificate, if the peer
+// presented one over TLS, was issued to the agency that said hello
+func verifyPeerAgency(clientSocket net.Conn, agency int) error {
+	tlsSocket, ok := clientSocket.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certificates := tlsSocket.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return nil
+	}
+	if name := certificates[0].Subject.CommonName; name != strconv.Itoa(agency) {
+		return fmt.Errorf("%w: certificate issued to agency %s", ErrAgencyMismatch, name)
+	}
+	return nil
+}
+
+// sessionAgency Parses the agency carried by MessageBetsFinished and
+// MessageWinnersQuery, which must be the one the session was opened for
+func sessionAgency(session *session, msg protocol.Message) (int, error) {
+	agency, err := decodeAgency(msg)
+	if err != nil {
+		return 0, err
+	}
+	if agency != session.agency {
+		return 0, fmt.Errorf("%w: got %d, session of %d", ErrAgencyMismatch, agency, session.agency)
+	}
+	return agency, nil
+}
@@ -0,0 +1,193 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// errChainMismatch Returned by the verification of a record whose digest
+// does not match its content and the records stored before it
+var errChainMismatch = errors.New("hash chain mismatch, the record or one before it was altered")
+
+// errLogMismatch Returned by the verification of a CSV store whose rows
+// do not end where its write-ahead log says, as when trailing rows were
+// dropped or the rows were rewritten along with their digests
+var errLogMismatch = errors.New("bets file does not match its log")
+
+// chainHash Digest of a stored record chained to the digest of the record
+// stored before it, so altering, removing or reordering records changes
+// the digest of every record after them. The first record is chained to
+// the zero digest
+type chainHash [sha256.Size]byte
+
+// nextChainHash Returns the digest of the record holding data stored right
+// after the one whose digest is prev
+func nextChainHash(prev chainHash, data []byte) chainHash {
+	hash := sha256.New()
+	hash.Write(prev[:])
+	hash.Write(data)
+
+	var next chainHash
+	hash.Sum(next[:0])
+	return next
+}
+
+// appendFields Appends the fields to dst, each prefixed by its big endian
+// uint32 length so no two lists of fields are appended alike
+func appendFields(dst []byte, fields []string) []byte {
+	for _, field := range fields {
+		dst = binary.BigEndian.AppendUint32(dst, uint32(len(field)))
+		dst = append(dst, field...)
+	}
+	return dst
+}
+
+func (h chainHash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+// parseChainHash Parses a digest written with String
+func parseChainHash(s string) (chainHash, error) {
+	var h chainHash
+	if hex.DecodedLen(len(s)) != len(h) {
+		return h, fmt.Errorf("invalid digest length: %d", len(s))
+	}
+	if _, err := hex.Decode(h[:], []byte(s)); err != nil {
+		return h, fmt.Errorf("invalid digest: %v", err)
+	}
+	return h, nil
+}
+
+// IntegrityError Locates the first record of a store failing verification
+type IntegrityError struct {
+	// Record Number of the record among the stored ones, starting at 1
+	Record int
+	// Line Line the record starts at, only set for CSV stores
+	Line int
+	// Offset Offset of the record in the file
+	Offset int64
+	Err    error
+}
+
+func (e *IntegrityError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("record %d at line %d: %v", e.Record, e.Line, e.Err)
+	}
+	return fmt.Sprintf("record %d at offset %d: %v", e.Record, e.Offset, e.Err)
+}
+
+func (e *IntegrityError) Unwrap() error {
+	return e.Err
+}
+
+// VerifyStore Checks every record of the store of the given kind at path
+// on fs: that it holds valid bets and that its digest matches the hash
+// chain. For CSV stores the size of the file and the digest of its last
+// row must also match the write-ahead log. Returns the amount of bets
+// verified, or an *IntegrityError locating the first record failing. The
+// whole file is checked, so rows a crash left past the committed ones are
+// reported until the server opens the store again.
+//
+// The chain has no key, it catches corruption and edits that leave it
+// broken. Records rewritten along with their digests, and the log of a CSV
+// store with them, or records dropped from the end of a log store, still
+// verify
+func VerifyStore(fs afero.Fs, kind string, path string) (int, error) {
+	return EachVerifiedBet(fs, kind, path, func(*Bet) error { return nil })
+}
+
+// EachVerifiedBet Verifies the store like VerifyStore, calling fn with
+// every bet once its record was verified. The file is only read. The scan
+// stops at the first error returned by fn, which is returned
+func EachVerifiedBet(fs afero.Fs, kind string, path string, fn func(bet *Bet) error) (int, error) {
+	if kind != StorageCSV && kind != StorageLog {
+		return 0, fmt.Errorf("storage type %q is not kept in a file", kind)
+	}
+
+	file, err := fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	if kind == StorageCSV {
+		return verifyCSVAgainstLog(fs, path, file, fn)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat file: %v", err)
+	}
+	return verifyLog(file, info.Size(), fn)
+}
+
+// verifyCSVAgainstLog Verifies the bets file at path, open as file, and
+// checks it ends where its write-ahead log says, if it has one
+func verifyCSVAgainstLog(fs afero.Fs, path string, file afero.File, fn func(bet *Bet) error) (int, error) {
+	committed, head, logged, err := walHead(fs, path)
+	if err != nil {
+		return 0, err
+	}
+	bets, chain, err := verifyCSV(file, fn)
+	if err != nil || !logged {
+		return bets, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return bets, fmt.Errorf("failed to stat file: %v", err)
+	}
+	if info.Size() != committed {
+		err = fmt.Errorf("%w, it has %d bytes and the log %d", errLogMismatch, info.Size(), committed)
+	} else if chain != head {
+		err = fmt.Errorf("%w, its last digest is %s and the log %s", errLogMismatch, chain, head)
+	}
+	if err != nil {
+		return bets, &IntegrityError{Record: bets + 1, Offset: info.Size(), Err: err}
+	}
+	return bets, nil
+}
+
+// verifyLog Checks the records of the first size bytes of a log written by
+// LogStore, calling fn with their bets. Returns the amount of bets they
+// hold
+func verifyLog(file io.ReaderAt, size int64, fn func(bet *Bet) error) (int, error) {
+	reader := newWalReader(file, size)
+	var chain chainHash
+	bets := 0
+
+	for record := 1; ; record++ {
+		offset := reader.offset
+		fail := func(err error) error {
+			return &IntegrityError{Record: record, Offset: offset, Err: err}
+		}
+
+		batch, err := nextLogBatch(reader)
+		if err == io.EOF {
+			return bets, nil
+		}
+		if err != nil {
+			return bets, fail(err)
+		}
+		chain = nextChainHash(chain, batch.chained)
+		if batch.chain != chain {
+			return bets, fail(errChainMismatch)
+		}
+		for batch.bets.remaining() > 0 {
+			bet, err := batch.bets.next(func(int) bool { return true })
+			if err != nil {
+				return bets, fail(err)
+			}
+			if err := fn(bet); err != nil {
+				return bets, err
+			}
+			bets++
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// storeTestBatches Stores 3 batches of 3 bets, reopening the store between
+// them
+func storeTestBatches(t *testing.T, fs afero.Fs, kind string) {
+	for seq := 1; seq <= 3; seq++ {
+		store := openTestStore(t, fs, kind)
+		_, err := store.StoreBatch(1, uint32(seq), testBets(1, seq, 3))
+		assert.Nil(t, err)
+		assert.Nil(t, store.Close())
+	}
+}
+
+func TestVerifyStoreAcceptsStoredBets(t *testing.T) {
+	eachFileStoreKind(t, func(t *testing.T, fs afero.Fs, kind string) {
+		storeTestBatches(t, fs, kind)
+
+		verified, err := VerifyStore(fs, kind, testStorePath)
+		assert.Nil(t, err)
+		assert.Equal(t, 9, verified)
+	})
+}
+
+func TestVerifyStoreReportsFirstTamperedRow(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storeTestBatches(t, fs, StorageCSV)
+	content, err := afero.ReadFile(fs, testStorePath)
+	assert.Nil(t, err)
+	rows := strings.SplitAfter(string(content), "\n")
+
+	tamper := func(rows []string) *IntegrityError {
+		assert.Nil(t, afero.WriteFile(fs, testStorePath, []byte(strings.Join(rows, "")), 0644))
+		_, err := VerifyStore(fs, StorageCSV, testStorePath)
+		var integrityErr *IntegrityError
+		assert.ErrorAs(t, err, &integrityErr)
+		return integrityErr
+	}
+
+	// A changed number, keeping the digest of the row
+	changed := append([]string{}, rows...)
+	fields := strings.Split(changed[4], ",")
+	fields[5] = "7574"
+	changed[4] = strings.Join(fields, ",")
+	integrityErr := tamper(changed)
+	assert.Equal(t, 5, integrityErr.Line)
+	assert.ErrorIs(t, integrityErr, errChainMismatch)
+
+	// A removed row breaks the chain of the one after it
+	removed := append(append([]string{}, rows[:2]...), rows[3:]...)
+	integrityErr = tamper(removed)
+	assert.Equal(t, 3, integrityErr.Line)
+	assert.ErrorIs(t, integrityErr, errChainMismatch)
+
+	// As does swapping two rows
+	swapped := append([]string{}, rows...)
+	swapped[6], swapped[7] = swapped[7], swapped[6]
+	integrityErr = tamper(swapped)
+	assert.Equal(t, 7, integrityErr.Line)
+	assert.ErrorIs(t, integrityErr, errChainMismatch)
+
+	// And a row that is not a valid bet
+	invalid := append([]string{}, rows...)
+	invalid[8] = strings.Replace(invalid[8], "2000-12-20", "20-12-2000", 1)
+	integrityErr = tamper(invalid)
+	assert.Equal(t, 9, integrityErr.Line)
+	assert.ErrorContains(t, integrityErr, "invalid birthdate")
+}
+
+func TestVerifyStoreChecksCSVStoreAgainstItsLog(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storeTestBatches(t, fs, StorageCSV)
+	content, err := afero.ReadFile(fs, testStorePath)
+	assert.Nil(t, err)
+	rows := strings.SplitAfter(string(content), "\n")
+
+	// Dropping the last row leaves a valid chain, shorter than the log
+	assert.Nil(t, afero.WriteFile(fs, testStorePath, []byte(strings.Join(rows[:8], "")), 0644))
+	verified, err := VerifyStore(fs, StorageCSV, testStorePath)
+	assert.Equal(t, 8, verified)
+	assert.ErrorIs(t, err, errLogMismatch)
+	assert.ErrorContains(t, err, "bytes")
+
+	// As does changing a number and computing every digest again
+	rechained := afero.NewMemMapFs()
+	for seq := 1; seq <= 3; seq++ {
+		bets := testBets(1, seq, 3)
+		if seq == 2 {
+			bets[1].number = 7
+		}
+		store := openTestStore(t, rechained, StorageCSV)
+		_, err := store.StoreBatch(1, uint32(seq), bets)
+		assert.Nil(t, err)
+		assert.Nil(t, store.Close())
+	}
+	content, err = afero.ReadFile(rechained, testStorePath)
+	assert.Nil(t, err)
+	assert.Nil(t, afero.WriteFile(fs, testStorePath, content, 0644))
+	verified, err = VerifyStore(fs, StorageCSV, testStorePath)
+	assert.Equal(t, 9, verified)
+	assert.ErrorIs(t, err, errLogMismatch)
+	assert.ErrorContains(t, err, "last digest")
+}
+
+func TestVerifyStoreReportsFirstTamperedLogRecord(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storeTestBatches(t, fs, StorageLog)
+	content, err := afero.ReadFile(fs, testStorePath)
+	assert.Nil(t, err)
+
+	var bodies [][]byte
+	reader := newWalReader(bytes.NewReader(content), int64(len(content)))
+	for i := 0; i < 3; i++ {
+		body, err := reader.next()
+		assert.Nil(t, err)
+		bodies = append(bodies, body)
+	}
+	second := int64(walHeaderSize + len(bodies[0]))
+
+	// A changed byte is caught by the checksum of the record
+	corrupt := append([]byte{}, content...)
+	corrupt[int(second)+walHeaderSize+len(chainHash{})+logBatchHeaderSize+1] ^= 0xff
+	assert.Nil(t, afero.WriteFile(fs, testStorePath, corrupt, 0644))
+	_, err = VerifyStore(fs, StorageLog, testStorePath)
+	var integrityErr *IntegrityError
+	assert.ErrorAs(t, err, &integrityErr)
+	assert.Equal(t, 2, integrityErr.Record)
+	assert.Equal(t, second, integrityErr.Offset)
+	assert.ErrorIs(t, err, errCorruptRecord)
+
+	// Rewriting the checksum along with it still breaks the chain
+	bodies[1][len(chainHash{})+logBatchHeaderSize+1] ^= 0xff
+	var tampered []byte
+	for _, body := range bodies {
+		tampered, err = appendWalRecord(tampered, body)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, afero.WriteFile(fs, testStorePath, tampered, 0644))
+	_, err = VerifyStore(fs, StorageLog, testStorePath)
+	assert.ErrorAs(t, err, &integrityErr)
+	assert.Equal(t, 2, integrityErr.Record)
+	assert.ErrorIs(t, err, errChainMismatch)
+}
+
+func TestVerifyStoreRefusesMemoryStore(t *testing.T) {
+	_, err := VerifyStore(afero.NewMemMapFs(), StorageMemory, testStorePath)
+	assert.NotNil(t, err)
+}
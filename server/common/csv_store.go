@@ -0,0 +1,588 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/spf13/afero"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+)
+
+const (
+	// walCompactSize Size the write-ahead log may reach before it is
+	// compacted into a checkpoint
+	walCompactSize = 4 << 20
+
+	// walCheckpoint Kind of the record starting the write-ahead log,
+	// holding the committed size of the bets file, the digest of its last
+	// row and the highest sequence number stored of every agency
+	walCheckpoint = 1
+	// walBatch Kind of the records holding the rows of a stored batch,
+	// along with its agency, sequence number and the digest of its last
+	// row
+	walBatch = 2
+
+	// csvFields Fields of a row: those of the bet and its digest
+	csvFields = 7
+)
+
+// walPath Returns the path of the write-ahead log kept next to the bets
+// file at path
+func walPath(path string) string {
+	return path + ".wal"
+}
+
+// CSVStore Append only storage of bets as rows of a CSV file, each ending
+// with the digest chaining it to the row before it, see chainRow. Batches are
+// written through a write-ahead log kept next to the file: the rows of a
+// batch are first appended to the log as a checksummed record, see
+// appendWalRecord, and only once the record is synced are they appended to
+// the bets file. A batch is committed once its record is synced, so a
+// crash at any point loses at most batches that were not acknowledged.
+// When the store is opened the log is replayed, discarding a torn record
+// at its end and writing again the rows missing from the bets file. The
+// log then starts over with a checkpoint record, and so it does whenever
+// it grows past walCompactSize. Calls are serialized so rows of different
+// batches never interleave
+type CSVStore struct {
+	mu   sync.Mutex
+	fs   afero.Fs
+	path string
+	file afero.File
+	wal  afero.File
+	// walSize Size of the write-ahead log, all of it committed
+	walSize int64
+	// compactSize Size past which the write-ahead log is compacted
+	compactSize int64
+	sequences   batchSequences
+	// size Size of the bets file, all of it committed
+	size int64
+	// chain Digest of the last committed row
+	chain chainHash
+	// failed Set once a committed batch could not be written to the bets
+	// file, which must be recovered by opening the store again
+	failed error
+}
+
+// NewCSVStore Opens the bets file at path in append mode, creating it if
+// it does not exist, and recovers it from its write-ahead log. A bets
+// file without a log is adopted as it is once verified
+func NewCSVStore(fs afero.Fs, path string) (*CSVStore, error) {
+	file, err := fs.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+
+	s := &CSVStore{
+		fs:          fs,
+		path:        path,
+		file:        file,
+		compactSize: walCompactSize,
+		sequences:   make(batchSequences),
+	}
+	if err := s.recover(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// recover Brings the bets file up to date with the write-ahead log and
+// starts a new log holding only the resulting checkpoint
+func (s *CSVStore) recover() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %v", err)
+	}
+	size := info.Size()
+
+	committed, err := s.replay(size)
+	if err != nil {
+		return err
+	}
+	if size > committed {
+		if err := truncateFile(s.file, committed); err != nil {
+			return fmt.Errorf("failed to discard uncommitted bets: %v", err)
+		}
+		log.Warningf("action: recover_store | result: success | msg: discarded uncommitted bets | bytes: %d", size-committed)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %v", err)
+	}
+	s.size = committed
+
+	return s.compact()
+}
+
+// replay Reads the write-ahead log writing again the rows of the batches
+// missing from the bets file, which has size bytes, or not matching the
+// log. Returns the committed size of the bets file
+func (s *CSVStore) replay(size int64) (int64, error) {
+	wal, err := s.fs.Open(walPath(s.path))
+	if errors.Is(err, os.ErrNotExist) {
+		return size, s.adopt()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open log: %v", err)
+	}
+	defer wal.Close()
+	info, err := wal.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat log: %v", err)
+	}
+	if info.Size() == 0 {
+		return size, s.adopt()
+	}
+
+	reader := newWalReader(wal, info.Size())
+	body, err := reader.next()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read log checkpoint: %w", err)
+	}
+	committed, err := s.loadCheckpoint(body)
+	if err != nil {
+		return 0, err
+	}
+	if size < committed {
+		return 0, fmt.Errorf("bets file is shorter than its committed size: %d < %d", size, committed)
+	}
+
+	// Rows past the checkpoint were appended without a sync, they are
+	// checked against the log before being kept
+	bets, err := s.fs.Open(s.path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer bets.Close()
+
+	replayed := 0
+	for {
+		body, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, errTornRecord) {
+			log.Warningf("action: recover_store | result: success | msg: discarded torn log record | bytes: %d | error: %v", info.Size()-reader.offset, err)
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read log: %w", err)
+		}
+
+		agency, seq, chain, rows, err := decodeWalBatch(body)
+		if err != nil {
+			return 0, fmt.Errorf("invalid log record at offset %d: %v", reader.start, err)
+		}
+		end := committed + int64(len(rows))
+		written := size >= end
+		if written {
+			if written, err = holdsAt(bets, committed, rows); err != nil {
+				return 0, fmt.Errorf("failed to read file: %v", err)
+			}
+		}
+		if !written {
+			// The rows of the batch are missing, half written or garbled
+			if err := truncateFile(s.file, committed); err != nil {
+				return 0, fmt.Errorf("failed to replay log: %v", err)
+			}
+			if _, err := s.file.Write(rows); err != nil {
+				return 0, fmt.Errorf("failed to replay log: %v", err)
+			}
+			size = end
+			replayed++
+		}
+		s.sequences.stored(agency, seq)
+		s.chain = chain
+		committed = end
+	}
+
+	if replayed > 0 {
+		log.Warningf("action: recover_store | result: success | msg: replayed logged batches | batches: %d", replayed)
+	}
+	return committed, nil
+}
+
+// holdsAt Reports whether file holds data at offset
+func holdsAt(file io.ReaderAt, offset int64, data []byte) (bool, error) {
+	buf := make([]byte, len(data))
+	n, err := file.ReadAt(buf, offset)
+	if err == io.EOF && n == len(buf) {
+		err = nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(buf, data), nil
+}
+
+// adopt Verifies a bets file written without a log, taking the digest of
+// its last row
+func (s *CSVStore) adopt() error {
+	file, err := s.fs.Open(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	_, chain, err := verifyCSV(file, func(*Bet) error { return nil })
+	if err != nil {
+		return fmt.Errorf("failed to verify bets file: %w", err)
+	}
+	s.chain = chain
+	return nil
+}
+
+// loadCheckpoint Loads the sequence numbers and digest of a checkpoint
+// record and returns the committed size of the bets file it holds
+func (s *CSVStore) loadCheckpoint(body []byte) (int64, error) {
+	committed, chain, entries, err := decodeWalCheckpoint(body)
+	if err != nil {
+		return 0, err
+	}
+	s.chain = chain
+	for i := 0; i < len(entries)/8; i++ {
+		agency := int(binary.BigEndian.Uint32(entries[i*8:]))
+		seq := binary.BigEndian.Uint32(entries[i*8+4:])
+		s.sequences.stored(agency, seq)
+	}
+	return committed, nil
+}
+
+// compact Replaces the write-ahead log with one holding only a checkpoint
+// of the current state. The bets file is synced first, as the log will
+// not hold its rows anymore. The new log is written aside and renamed
+// over the old one, so a crash leaves either of them
+func (s *CSVStore) compact() error {
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %v", err)
+	}
+
+	agencies := make([]int, 0, len(s.sequences))
+	for agency := range s.sequences {
+		agencies = append(agencies, agency)
+	}
+	sort.Ints(agencies)
+	body := []byte{walCheckpoint}
+	body = binary.BigEndian.AppendUint64(body, uint64(s.size))
+	body = append(body, s.chain[:]...)
+	body = binary.BigEndian.AppendUint32(body, uint32(len(agencies)))
+	for _, agency := range agencies {
+		body = binary.BigEndian.AppendUint32(body, uint32(agency))
+		body = binary.BigEndian.AppendUint32(body, s.sequences[agency])
+	}
+	record, err := appendWalRecord(nil, body)
+	if err != nil {
+		return err
+	}
+
+	path := walPath(s.path)
+	if err := shared.ReplaceFile(s.fs, path, record, 0644); err != nil {
+		return fmt.Errorf("failed to replace log: %v", err)
+	}
+
+	wal, err := s.fs.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log: %v", err)
+	}
+	if s.wal != nil {
+		s.wal.Close()
+	}
+	s.wal = wal
+	s.walSize = int64(len(record))
+	return nil
+}
+
+// StoreBatch Logs the bets of the batch and then appends them to the bets
+// file, see BetStore. Stored bets are synced to the write-ahead log
+// before it returns
+func (s *CSVStore) StoreBatch(agency int, seq uint32, bets []*Bet) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failed != nil {
+		return false, s.failed
+	}
+	if s.sequences.isDuplicate(agency, seq) {
+		return false, nil
+	}
+
+	rows, chain, err := encodeRows(s.chain, bets)
+	if err != nil {
+		return false, err
+	}
+	body := []byte{walBatch}
+	body = binary.BigEndian.AppendUint32(body, uint32(agency))
+	body = binary.BigEndian.AppendUint32(body, seq)
+	body = append(body, chain[:]...)
+	body = append(body, rows...)
+	record, err := appendWalRecord(nil, body)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = s.wal.Write(record)
+	if err == nil {
+		err = s.wal.Sync()
+	}
+	if err != nil {
+		// Leave the log as it was so the next record starts where it
+		// should
+		truncateFile(s.wal, s.walSize)
+		return false, fmt.Errorf("failed to write log: %v", err)
+	}
+	s.walSize += int64(len(record))
+	s.sequences.stored(agency, seq)
+	s.chain = chain
+
+	// The batch is committed, if its rows cannot be written they are
+	// written again when the store is recovered
+	if _, err := s.file.Write(rows); err != nil {
+		truncateFile(s.file, s.size)
+		s.failed = fmt.Errorf("store must be reopened, failed to write committed bets: %v", err)
+		log.Errorf("action: store_bets | result: fail | error: %v", s.failed)
+		return true, nil
+	}
+	s.size += int64(len(rows))
+
+	if s.walSize >= s.compactSize {
+		if err := s.compact(); err != nil {
+			// The log in use may have been replaced already, so appending
+			// to it would not commit anything
+			s.failed = fmt.Errorf("store must be reopened, failed to compact log: %v", err)
+			log.Errorf("action: compact_log | result: fail | error: %v", err)
+		}
+	}
+	return true, nil
+}
+
+// encodeRows Returns the CSV rows of the bets stored after the row whose
+// digest is prev, along with the digest of the last of them
+func encodeRows(prev chainHash, bets []*Bet) ([]byte, chainHash, error) {
+	buf := bytes.Buffer{}
+	writer := csv.NewWriter(&buf)
+
+	for _, bet := range bets {
+		record := bet.fields()
+		prev = chainRow(prev, record)
+		if err := writer.Write(append(record, prev.String())); err != nil {
+			return nil, prev, fmt.Errorf("error writing record to csv: %v", err)
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return nil, prev, fmt.Errorf("error writing record to csv: %v", err)
+	}
+	return buf.Bytes(), prev, nil
+}
+
+// chainRow Returns the digest of the row holding the fields of a bet
+// stored after the row whose digest is prev. Fields are prefixed by their
+// length, so the digest does not depend on how the row is quoted
+func chainRow(prev chainHash, fields []string) chainHash {
+	return nextChainHash(prev, appendFields(nil, fields))
+}
+
+// verifyCSV Checks the rows of a bets file written by CSVStore, calling fn
+// with their bets. Returns the amount of bets and the digest of the last
+// row
+func verifyCSV(file io.Reader, fn func(bet *Bet) error) (int, chainHash, error) {
+	reader := csv.NewReader(bufio.NewReader(file))
+	reader.FieldsPerRecord = csvFields
+	reader.ReuseRecord = true
+	var chain chainHash
+
+	for bets := 0; ; bets++ {
+		offset := reader.InputOffset()
+		row, err := reader.Read()
+		if err == io.EOF {
+			return bets, chain, nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return bets, chain, &IntegrityError{Record: bets + 1, Line: parseErr.StartLine, Offset: offset, Err: parseErr.Err}
+		}
+		if err != nil {
+			return bets, chain, fmt.Errorf("failed to read file: %v", err)
+		}
+
+		line, _ := reader.FieldPos(0)
+		fail := func(err error) error {
+			return &IntegrityError{Record: bets + 1, Line: line, Offset: offset, Err: err}
+		}
+		bet, err := NewBet(row[0], row[1], row[2], row[3], row[4], row[5])
+		if err != nil {
+			return bets, chain, fail(err)
+		}
+		digest, err := parseChainHash(row[6])
+		if err != nil {
+			return bets, chain, fail(err)
+		}
+		if digest != chainRow(chain, row[:6]) {
+			return bets, chain, fail(errChainMismatch)
+		}
+		chain = digest
+		if err := fn(bet); err != nil {
+			return bets, chain, err
+		}
+	}
+}
+
+// decodeWalBatch Returns the agency, sequence number, digest of the last
+// row and rows held by the body of a batch record
+func decodeWalCheckpoint(body []byte) (int64, chainHash, []byte, error) {
+	var chain chainHash
+	header := 1 + 8 + len(chain) + 4
+	if len(body) < header || body[0] != walCheckpoint {
+		return 0, chain, nil, errors.New("log does not start with a checkpoint")
+	}
+	committed := int64(binary.BigEndian.Uint64(body[1:]))
+	copy(chain[:], body[9:])
+	count := int(binary.BigEndian.Uint32(body[header-4:]))
+	entries := body[header:]
+	if len(entries) != count*8 {
+		return 0, chain, nil, errors.New("invalid log checkpoint")
+	}
+	return committed, chain, entries, nil
+}
+
+// walHead Reads the write-ahead log of the bets file at path, returning
+// the size the file is committed to and the digest its last row must
+// have. ok is false for files without a log. A torn last record is left
+// out, like when the store is opened
+func walHead(fs afero.Fs, path string) (size int64, chain chainHash, ok bool, err error) {
+	wal, err := fs.Open(walPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, chain, false, nil
+	}
+	if err != nil {
+		return 0, chain, false, fmt.Errorf("failed to open log: %v", err)
+	}
+	defer wal.Close()
+	info, err := wal.Stat()
+	if err != nil {
+		return 0, chain, false, fmt.Errorf("failed to stat log: %v", err)
+	}
+	if info.Size() == 0 {
+		return 0, chain, false, nil
+	}
+
+	reader := newWalReader(wal, info.Size())
+	body, err := reader.next()
+	if err != nil {
+		return 0, chain, false, fmt.Errorf("failed to read log checkpoint: %w", err)
+	}
+	if size, chain, _, err = decodeWalCheckpoint(body); err != nil {
+		return 0, chain, false, err
+	}
+	for {
+		body, err := reader.next()
+		if err == io.EOF || errors.Is(err, errTornRecord) {
+			return size, chain, true, nil
+		}
+		if err != nil {
+			return 0, chain, false, fmt.Errorf("failed to read log: %w", err)
+		}
+		_, _, batchChain, rows, err := decodeWalBatch(body)
+		if err != nil {
+			return 0, chain, false, fmt.Errorf("invalid log record at offset %d: %v", reader.start, err)
+		}
+		size += int64(len(rows))
+		chain = batchChain
+	}
+}
+
+func decodeWalBatch(body []byte) (int, uint32, chainHash, []byte, error) {
+	var chain chainHash
+	header := 1 + 4 + 4 + len(chain)
+	if len(body) < header || body[0] != walBatch {
+		return 0, 0, chain, nil, errors.New("not a batch record")
+	}
+	agency := int(binary.BigEndian.Uint32(body[1:]))
+	seq := binary.BigEndian.Uint32(body[5:])
+	copy(chain[:], body[9:])
+	return agency, seq, chain, body[header:], nil
+}
+
+// EachBet Calls fn with every stored bet, see BetStore. Bets are read one
+// at a time from the file
+func (s *CSVStore) EachBet(fn func(bet *Bet) error) error {
+	return s.scan(func(int) bool { return true }, fn)
+}
+
+// EachAgencyBet Calls fn with every stored bet of the agency, see
+// BetStore. Rows of other agencies are skipped without being parsed
+func (s *CSVStore) EachAgencyBet(agency int, fn func(bet *Bet) error) error {
+	return s.scan(func(betAgency int) bool { return betAgency == agency }, fn)
+}
+
+// scan Reads the bets committed when it is called and calls fn with the
+// ones whose agency matches. The file is only appended to, so it is read
+// without holding the lock while other batches are stored
+func (s *CSVStore) scan(match func(agency int) bool, fn func(bet *Bet) error) error {
+	s.mu.Lock()
+	size := s.size
+	s.mu.Unlock()
+
+	file, err := s.fs.Open(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(bufio.NewReader(io.LimitReader(file, size)))
+	reader.FieldsPerRecord = csvFields
+	reader.ReuseRecord = true
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read file: %v", err)
+		}
+
+		agency, err := strconv.Atoi(record[0])
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return fmt.Errorf("failed to create bet at line %d: invalid agency: %v", line, err)
+		}
+		if !match(agency) {
+			continue
+		}
+		bet, err := NewBet(record[0], record[1], record[2], record[3], record[4], record[5])
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return fmt.Errorf("failed to create bet at line %d: %v", line, err)
+		}
+		if err := fn(bet); err != nil {
+			return err
+		}
+	}
+}
+
+// Close Syncs the bets file and releases the file handles of the store
+func (s *CSVStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.file.Sync()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	if walErr := s.wal.Close(); err == nil {
+		err = walErr
+	}
+	return err
+}
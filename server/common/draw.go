@@ -0,0 +1,220 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+)
+
+// drawSeedSize Bytes of the secret seed of a draw
+const drawSeedSize = 32
+
+// ErrDrawRecorded Returned when writing a draw record where one already
+// exists, a published draw is never replaced
+var ErrDrawRecorded = errors.New("draw already recorded")
+
+// Draw Outcome of a draw, written as JSON to the draw record. Before
+// intake closes only the commitment, the SHA-256 digest of a secret seed,
+// is published. Once every agency finished the seed is revealed along with
+// the digest of every stored bet, see betsDigest, and the winning number
+// derived from both, see winningNumber. Anyone holding the store can
+// recompute it, see VerifyDraw.
+//
+// The commitment only proves the seed did not change once it was
+// published, and that agencies could not know the number while betting.
+// It does not stop the server from picking it: the server knows the seed
+// from the start and, through the agencies keys, can store bets of its own
+// until the number it wants comes out before letting intake close. The
+// draw is as fair as the server operating it
+type Draw struct {
+	Commitment string `json:"commitment"`
+	Seed       string `json:"seed"`
+	// Bets Amount of bets that took part in the draw
+	Bets       int    `json:"bets"`
+	BetsDigest string `json:"bets_digest"`
+	Number     int    `json:"number"`
+	// Prizes Tiers paid to the bets matching Number, see Bet.Prize
+	Prizes  PrizeTable `json:"prizes"`
+	DrawnAt time.Time  `json:"drawn_at"`
+}
+
+// loadDrawSeed Reads the hex encoded seed at path, creating a random one
+// if the file does not exist. The seed is kept so a restarted server
+// keeps the commitment it already published
+func loadDrawSeed(fs afero.Fs, path string) ([]byte, error) {
+	content, err := afero.ReadFile(fs, path)
+	if errors.Is(err, os.ErrNotExist) {
+		seed := make([]byte, drawSeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, fmt.Errorf("failed to create draw seed: %v", err)
+		}
+		if err := shared.ReplaceFile(fs, path, []byte(hex.EncodeToString(seed)+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("failed to write draw seed: %v", err)
+		}
+		return seed, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read draw seed: %v", err)
+	}
+
+	seed, err := decodeDrawSeed(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid draw seed at %s: %v", path, err)
+	}
+	return seed, nil
+}
+
+func decodeDrawSeed(s string) ([]byte, error) {
+	seed, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != drawSeedSize {
+		return nil, fmt.Errorf("seed must be %d bytes, got %d", drawSeedSize, len(seed))
+	}
+	return seed, nil
+}
+
+// drawCommitment Returns the commitment published for the seed
+func drawCommitment(seed []byte) string {
+	sum := sha256.Sum256(seed)
+	return hex.EncodeToString(sum[:])
+}
+
+// betsDigest SHA-256 digest of the bets of a draw, taken over their fields
+// in the order they were stored, see appendFields
+type betsDigest struct {
+	hash hash.Hash
+	buf  []byte
+	bets int
+}
+
+func newBetsDigest() *betsDigest {
+	return &betsDigest{hash: sha256.New()}
+}
+
+// add Adds the bet to the digest, it fits EachBet
+func (d *betsDigest) add(bet *Bet) error {
+	d.buf = appendFields(d.buf[:0], bet.fields())
+	d.hash.Write(d.buf)
+	d.bets++
+	return nil
+}
+
+func (d *betsDigest) sum() []byte {
+	return d.hash.Sum(nil)
+}
+
+// winningNumber Derives the winning number from the seed and the digest of
+// the bets: the first 8 bytes of the SHA-256 digest of both, as a big
+// endian integer, modulo the amount of numbers a bet can be placed on
+func winningNumber(seed []byte, betsDigest []byte) int {
+	hash := sha256.New()
+	hash.Write(seed)
+	hash.Write(betsDigest)
+	return int(binary.BigEndian.Uint64(hash.Sum(nil)) % (maxBetNumber + 1))
+}
+
+// NewDraw Draws the winning number among the bets of the store with the
+// secret seed, see Draw, paying the prizes of the table
+func NewDraw(seed []byte, store BetStore, prizes PrizeTable) (*Draw, error) {
+	digest := newBetsDigest()
+	if err := store.EachBet(digest.add); err != nil {
+		return nil, err
+	}
+	sum := digest.sum()
+
+	return &Draw{
+		Commitment: drawCommitment(seed),
+		Seed:       hex.EncodeToString(seed),
+		Bets:       digest.bets,
+		BetsDigest: hex.EncodeToString(sum),
+		Number:     winningNumber(seed, sum),
+		Prizes:     prizes,
+		DrawnAt:    time.Now().UTC(),
+	}, nil
+}
+
+// WriteDraw Writes the draw record at path. Fails with ErrDrawRecorded if
+// there is one already
+func WriteDraw(fs afero.Fs, path string, draw *Draw) error {
+	exists, err := afero.Exists(fs, path)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%w at %s", ErrDrawRecorded, path)
+	}
+
+	content, err := json.MarshalIndent(draw, "", "  ")
+	if err != nil {
+		return err
+	}
+	return shared.ReplaceFile(fs, path, append(content, '\n'), 0644)
+}
+
+// ReadDraw Reads the draw record at path
+func ReadDraw(fs afero.Fs, path string) (*Draw, error) {
+	content, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read draw record: %w", err)
+	}
+	draw := &Draw{}
+	if err := json.Unmarshal(content, draw); err != nil {
+		return nil, fmt.Errorf("invalid draw record: %v", err)
+	}
+	return draw, nil
+}
+
+// VerifyDraw Recomputes the draw from the store of the given kind at path
+// on fs, verifying the store along the way, see EachVerifiedBet. Fails if
+// the seed does not match the commitment, or if the bets or the winning
+// number do not match those of the draw
+func VerifyDraw(draw *Draw, fs afero.Fs, kind string, path string) error {
+	return draw.verify(func(fn func(bet *Bet) error) error {
+		if _, err := EachVerifiedBet(fs, kind, path, fn); err != nil {
+			return fmt.Errorf("failed to verify store: %w", err)
+		}
+		return nil
+	})
+}
+
+// verify Recomputes the draw from the bets eachBet goes over, like
+// VerifyDraw
+func (d *Draw) verify(eachBet func(fn func(bet *Bet) error) error) error {
+	seed, err := decodeDrawSeed(d.Seed)
+	if err != nil {
+		return fmt.Errorf("invalid seed: %v", err)
+	}
+	if drawCommitment(seed) != d.Commitment {
+		return errors.New("seed does not match the commitment")
+	}
+
+	digest := newBetsDigest()
+	if err := eachBet(digest.add); err != nil {
+		return err
+	}
+	if digest.bets != d.Bets {
+		return fmt.Errorf("store holds %d bets, the draw took %d", digest.bets, d.Bets)
+	}
+	sum := digest.sum()
+	if hex.EncodeToString(sum) != d.BetsDigest {
+		return errors.New("bets digest does not match the store")
+	}
+	if number := winningNumber(seed, sum); number != d.Number {
+		return fmt.Errorf("winning number is %d, the draw says %d", number, d.Number)
+	}
+	return nil
+}
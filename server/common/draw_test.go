@@ -0,0 +1,212 @@
+package common
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared/protocol"
+)
+
+const testDrawRecordPath = "/data/draw.json"
+
+// testPrizeTiers Prize table of the draws of the tests
+const testPrizeTiers = "exact:4,last3:3,last2:2"
+
+// drawTestLottery Stores a bet on every number for agency 1 in a CSV store
+// on fs and draws the lottery among them with a fixed seed
+func drawTestLottery(t *testing.T, fs afero.Fs) *lottery {
+	store := openTestStore(t, fs, StorageCSV)
+	t.Cleanup(func() { store.Close() })
+	_, err := store.StoreBatch(1, 1, testBets(1, 1, maxBetNumber+1))
+	assert.Nil(t, err)
+
+	// A fixed seed keeps the drawn number the same on every run
+	assert.Nil(t, afero.WriteFile(fs, "/data/draw-seed", []byte(strings.Repeat("5a", drawSeedSize)), 0600))
+	seed, err := loadDrawSeed(fs, "/data/draw-seed")
+	assert.Nil(t, err)
+	prizes, err := ParsePrizeTiers(testPrizeTiers)
+	assert.Nil(t, err)
+	lottery := newLottery(store, NewRegistry([]int{1}), seed, prizes, fs, testDrawRecordPath)
+	assert.Nil(t, lottery.finish(1))
+	return lottery
+}
+
+func TestLoadDrawSeedKeepsTheSeedAcrossRestarts(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	seed, err := loadDrawSeed(fs, "/data/draw-seed")
+	assert.Nil(t, err)
+	assert.Len(t, seed, drawSeedSize)
+
+	reloaded, err := loadDrawSeed(fs, "/data/draw-seed")
+	assert.Nil(t, err)
+	assert.Equal(t, seed, reloaded)
+
+	other, err := loadDrawSeed(fs, "/data/other-seed")
+	assert.Nil(t, err)
+	assert.NotEqual(t, seed, other)
+
+	assert.Nil(t, afero.WriteFile(fs, "/data/draw-seed", []byte("not hex\n"), 0600))
+	_, err = loadDrawSeed(fs, "/data/draw-seed")
+	assert.NotNil(t, err)
+}
+
+func TestLotteryRecordsAVerifiableDraw(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	lottery := drawTestLottery(t, fs)
+
+	draw, err := ReadDraw(fs, testDrawRecordPath)
+	assert.Nil(t, err)
+	assert.Equal(t, maxBetNumber+1, draw.Bets)
+	assert.Equal(t, drawCommitment(lottery.seed), draw.Commitment)
+	assert.Equal(t, hex.EncodeToString(lottery.seed), draw.Seed)
+	assert.Nil(t, VerifyDraw(draw, fs, StorageCSV, testStorePath))
+
+	assert.Equal(t, lottery.prizes, draw.Prizes)
+
+	// A single bet was placed on every number, so one matches it exactly,
+	// 9 more its last 3 digits and 90 more its last 2
+	winners, drawn, err := lottery.agencyWinners(1)
+	assert.Nil(t, err)
+	assert.True(t, drawn)
+	tiers := make(map[string]int)
+	for _, winner := range winners {
+		tiers[winner.Tier]++
+	}
+	assert.Equal(t, map[string]int{"exact": 1, "last3": 9, "last2": 90}, tiers)
+	assert.Contains(t, winners, protocol.Winner{Document: testBets(1, 1, maxBetNumber+1)[draw.Number].document, Tier: "exact"})
+
+	// Only the bets of the agency queried are reported
+	winners, drawn, err = lottery.agencyWinners(2)
+	assert.Nil(t, err)
+	assert.True(t, drawn)
+	assert.Empty(t, winners)
+}
+
+func TestLotteryStoresNoBetsOnceDrawn(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	lottery := drawTestLottery(t, fs)
+
+	stored, err := lottery.storeBatch(1, 2, testBets(1, 2, 1))
+	assert.ErrorIs(t, err, ErrAgencyFinished)
+	assert.False(t, stored)
+
+	draw, err := ReadDraw(fs, testDrawRecordPath)
+	assert.Nil(t, err)
+	assert.Nil(t, VerifyDraw(draw, fs, StorageCSV, testStorePath))
+}
+
+func TestRestoredLotteryKeepsTheRecordedDraw(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	lottery := drawTestLottery(t, fs)
+	recorded, err := ReadDraw(fs, testDrawRecordPath)
+	assert.Nil(t, err)
+
+	registry := NewRegistry([]int{1})
+	restored := newLottery(lottery.store, registry, lottery.seed, lottery.prizes, fs, testDrawRecordPath)
+	assert.Nil(t, restored.restore())
+	assert.Equal(t, recorded, restored.result)
+	assert.ErrorIs(t, registry.CanSubmit(1), ErrAgencyFinished)
+
+	assert.Nil(t, restored.finish(1))
+	draw, err := ReadDraw(fs, testDrawRecordPath)
+	assert.Nil(t, err)
+	assert.Equal(t, recorded, draw)
+	winners, drawn, err := restored.agencyWinners(1)
+	assert.Nil(t, err)
+	assert.True(t, drawn)
+	assert.Len(t, winners, 100)
+
+	assert.ErrorIs(t, WriteDraw(fs, testDrawRecordPath, draw), ErrDrawRecorded)
+}
+
+func TestRestoreRefusesRecordOfAnotherSeed(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	lottery := drawTestLottery(t, fs)
+
+	restored := newLottery(lottery.store, NewRegistry([]int{1}), make([]byte, drawSeedSize), lottery.prizes, fs, testDrawRecordPath)
+	assert.ErrorContains(t, restored.restore(), "another seed")
+	assert.Nil(t, restored.result)
+}
+
+func TestWinningNumberDependsOnSeedAndBets(t *testing.T) {
+	seed := make([]byte, drawSeedSize)
+	digest := newBetsDigest()
+	for _, bet := range testBets(1, 1, 3) {
+		assert.Nil(t, digest.add(bet))
+	}
+	number := winningNumber(seed, digest.sum())
+	assert.Equal(t, number, winningNumber(seed, digest.sum()))
+	assert.GreaterOrEqual(t, number, 0)
+	assert.LessOrEqual(t, number, maxBetNumber)
+
+	// Every other seed or set of bets may draw another number, some of
+	// these must
+	numbers := map[int]bool{number: true}
+	for i := 1; i < 8; i++ {
+		seed[0] = byte(i)
+		numbers[winningNumber(seed, digest.sum())] = true
+		assert.Nil(t, digest.add(testBets(1, 2, 1)[0]))
+		numbers[winningNumber(make([]byte, drawSeedSize), digest.sum())] = true
+	}
+	assert.Greater(t, len(numbers), 1)
+}
+
+func TestVerifyDrawDetectsAlteredDraws(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	drawTestLottery(t, fs)
+	recorded, err := ReadDraw(fs, testDrawRecordPath)
+	assert.Nil(t, err)
+
+	otherSeed := make([]byte, drawSeedSize)
+	cases := map[string]struct {
+		alter    func(draw *Draw)
+		expected string
+	}{
+		"seed": {
+			alter:    func(draw *Draw) { draw.Seed = hex.EncodeToString(otherSeed) },
+			expected: "does not match the commitment",
+		},
+		"seed and commitment": {
+			alter: func(draw *Draw) {
+				draw.Seed = hex.EncodeToString(otherSeed)
+				draw.Commitment = drawCommitment(otherSeed)
+			},
+			expected: "winning number",
+		},
+		"number": {
+			alter:    func(draw *Draw) { draw.Number = (draw.Number + 1) % (maxBetNumber + 1) },
+			expected: "winning number",
+		},
+		"bets": {
+			alter:    func(draw *Draw) { draw.Bets-- },
+			expected: "store holds",
+		},
+		"bets digest": {
+			alter:    func(draw *Draw) { draw.BetsDigest = strings.Repeat("0", len(draw.BetsDigest)) },
+			expected: "bets digest",
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			draw := *recorded
+			c.alter(&draw)
+			assert.ErrorContains(t, VerifyDraw(&draw, fs, StorageCSV, testStorePath), c.expected)
+		})
+	}
+}
+
+func TestVerifyDrawDetectsBetsStoredAfterTheDraw(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	lottery := drawTestLottery(t, fs)
+	draw, err := ReadDraw(fs, testDrawRecordPath)
+	assert.Nil(t, err)
+
+	_, err = lottery.store.StoreBatch(1, 2, testBets(1, 2, 1))
+	assert.Nil(t, err)
+
+	assert.ErrorContains(t, VerifyDraw(draw, fs, StorageCSV, testStorePath), "store holds")
+}
@@ -0,0 +1,95 @@
+//go:build linux
+
+package common
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenTCP Creates a listener bound to ip:port whose accept queue holds up
+// to backlog pending connections. The socket is created by hand since the
+// net package always uses the system wide backlog. An empty ip binds every
+// IPv4 interface
+func listenTCP(ip string, port int, backlog int, reuseAddr bool, reusePort bool) (*net.TCPListener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	family, sockaddr, err := toSockaddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_TCP)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	if err := setupSocket(fd, sockaddr, backlog, reuseAddr, reusePort); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	// FileListener duplicates the descriptor, so the original is closed
+	// along with the file once the listener is created
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("tcp:%s", addr))
+	defer file.Close()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, err
+	}
+	return listener.(*net.TCPListener), nil
+}
+
+func setupSocket(fd int, sockaddr unix.Sockaddr, backlog int, reuseAddr bool, reusePort bool) error {
+	if reuseAddr {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+			return os.NewSyscallError("setsockopt SO_REUSEADDR", err)
+		}
+	}
+	if reusePort {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			return os.NewSyscallError("setsockopt SO_REUSEPORT", err)
+		}
+	}
+	if err := unix.Bind(fd, sockaddr); err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+	if err := unix.Listen(fd, backlog); err != nil {
+		return os.NewSyscallError("listen", err)
+	}
+	return nil
+}
+
+// toSockaddr Converts a resolved address into the socket family and
+// address expected by the unix package
+func toSockaddr(addr *net.TCPAddr) (int, unix.Sockaddr, error) {
+	if addr.IP == nil || addr.IP.To4() != nil {
+		sockaddr := &unix.SockaddrInet4{Port: addr.Port}
+		if addr.IP != nil {
+			copy(sockaddr.Addr[:], addr.IP.To4())
+		}
+		return unix.AF_INET, sockaddr, nil
+	}
+
+	if addr.IP.To16() == nil {
+		return 0, nil, fmt.Errorf("invalid address: %s", addr)
+	}
+	sockaddr := &unix.SockaddrInet6{Port: addr.Port}
+	copy(sockaddr.Addr[:], addr.IP.To16())
+	if addr.Zone != "" {
+		iface, err := net.InterfaceByName(addr.Zone)
+		if err != nil {
+			return 0, nil, err
+		}
+		sockaddr.ZoneId = uint32(iface.Index)
+	}
+	return unix.AF_INET6, sockaddr, nil
+}
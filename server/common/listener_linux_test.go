@@ -0,0 +1,77 @@
+//go:build linux
+
+package common
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenTCPBindsToConfiguredLoopbackAddress(t *testing.T) {
+	listener, err := listenTCP("127.0.0.1", 0, 5, true, false)
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	assert.True(t, addr.IP.Equal(net.IPv4(127, 0, 0, 1)))
+	assert.NotZero(t, addr.Port)
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := listener.AcceptTCP()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+
+	conn, err := net.Dial("tcp", addr.String())
+	assert.Nil(t, err)
+	conn.Close()
+	assert.Nil(t, <-accepted)
+}
+
+func TestListenTCPBindsToIPv6Loopback(t *testing.T) {
+	listener, err := listenTCP("::1", 0, 5, true, false)
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	defer listener.Close()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	assert.True(t, addr.IP.Equal(net.IPv6loopback))
+}
+
+func TestListenTCPWithoutReusePortMustFailOnBusyPort(t *testing.T) {
+	first, err := listenTCP("127.0.0.1", 0, 5, true, false)
+	assert.Nil(t, err)
+	defer first.Close()
+	port := first.Addr().(*net.TCPAddr).Port
+
+	_, err = listenTCP("127.0.0.1", port, 5, true, false)
+	assert.True(t, errors.Is(err, syscall.EADDRINUSE))
+}
+
+func TestListenTCPWithReusePortSharesThePort(t *testing.T) {
+	first, err := listenTCP("127.0.0.1", 0, 5, true, true)
+	assert.Nil(t, err)
+	defer first.Close()
+	port := first.Addr().(*net.TCPAddr).Port
+
+	second, err := listenTCP("127.0.0.1", port, 5, true, true)
+	assert.Nil(t, err)
+	defer second.Close()
+
+	assert.Equal(t, first.Addr().String(), second.Addr().String())
+}
+
+func TestNewServerListensOnConfiguredAddress(t *testing.T) {
+	server, _ := startTestServer(t, testConfig(t, 1, 1))
+
+	addr := server.Addr().(*net.TCPAddr)
+	assert.True(t, addr.IP.IsLoopback())
+}
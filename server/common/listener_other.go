@@ -0,0 +1,19 @@
+//go:build !linux
+
+package common
+
+import (
+	"net"
+	"strconv"
+)
+
+// listenTCP Creates a listener bound to ip:port. Outside linux the socket
+// options and the backlog can not be set, so the system defaults are used
+func listenTCP(ip string, port int, backlog int, reuseAddr bool, reusePort bool) (*net.TCPListener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	log.Warningf("action: listen | result: in_progress | msg: listen backlog and socket options are only supported on linux")
+	return net.ListenTCP("tcp", addr)
+}
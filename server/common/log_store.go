@@ -0,0 +1,320 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	logUint32Size = 4
+	logStringSize = 2
+	// logBatchHeaderSize Agency, sequence number and amount of bets of a
+	// batch record
+	logBatchHeaderSize = 3 * logUint32Size
+)
+
+// LogStore Append only storage of bets as a binary log holding a record
+// per stored batch, framed with its length and checksum by
+// appendWalRecord. The body of a record starts with the digest chaining
+// it to the record before it, see chainHash, taken over the rest of the
+// body: the agency, sequence number and amount of bets of the batch and
+// then its bets, as big endian integers and strings prefixed by their
+// uint16 length:
+//
+//	body := chain agency seq count bet*
+//	bet  := agency firstName lastName document birthdate number
+//
+// A batch is committed once its record is synced. Since every record
+// carries its sequence number no other file is needed to tell resent
+// batches apart, the log is replayed when opened and a record left half
+// written by a crash is discarded
+type LogStore struct {
+	mu        sync.Mutex
+	fs        afero.Fs
+	path      string
+	file      afero.File
+	sequences batchSequences
+	// size Size of the log, all of it committed
+	size int64
+	// chain Digest of the last committed record
+	chain chainHash
+}
+
+// NewLogStore Opens the log at path, creating it if it does not exist
+func NewLogStore(fs afero.Fs, path string) (*LogStore, error) {
+	file, err := fs.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat log: %v", err)
+	}
+
+	s := &LogStore{fs: fs, path: path, file: file, sequences: make(batchSequences)}
+	if err := s.recover(info.Size()); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// recover Replays the records of the log, which has the given size,
+// loading the sequence numbers of the batches they hold. A trailing
+// partial record is removed
+func (s *LogStore) recover(size int64) error {
+	reader := newWalReader(s.file, size)
+	for {
+		batch, err := nextLogBatch(reader)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, errTornRecord) {
+			log.Warningf("action: recover_store | result: success | msg: discarded torn record | bytes: %d | error: %v", size-reader.offset, err)
+			break
+		}
+		if err != nil {
+			return err
+		}
+		s.sequences.stored(batch.agency, batch.seq)
+		s.chain = batch.chain
+	}
+
+	if err := truncateFile(s.file, reader.offset); err != nil {
+		return fmt.Errorf("failed to truncate log: %v", err)
+	}
+	s.size = reader.offset
+	return nil
+}
+
+// StoreBatch Appends a record holding the bets of the batch, see BetStore.
+// The record is synced before it returns
+func (s *LogStore) StoreBatch(agency int, seq uint32, bets []*Bet) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sequences.isDuplicate(agency, seq) {
+		return false, nil
+	}
+
+	record, chain, err := encodeLogRecord(s.chain, agency, seq, bets)
+	if err != nil {
+		return false, err
+	}
+	_, err = s.file.Write(record)
+	if err != nil {
+		err = fmt.Errorf("failed to write log: %v", err)
+	} else if err = s.file.Sync(); err != nil {
+		err = fmt.Errorf("failed to sync log: %v", err)
+	}
+	if err != nil {
+		// Leave the log as it was so the next record starts where it
+		// should
+		truncateFile(s.file, s.size)
+		return false, err
+	}
+
+	s.size += int64(len(record))
+	s.sequences.stored(agency, seq)
+	s.chain = chain
+	return true, nil
+}
+
+// EachBet Calls fn with every stored bet, see BetStore. Records are read
+// one at a time from the log
+func (s *LogStore) EachBet(fn func(bet *Bet) error) error {
+	return s.scan(func(int) bool { return true }, fn)
+}
+
+// EachAgencyBet Calls fn with every stored bet of the agency, see BetStore
+func (s *LogStore) EachAgencyBet(agency int, fn func(bet *Bet) error) error {
+	return s.scan(func(betAgency int) bool { return betAgency == agency }, fn)
+}
+
+// scan Reads the records committed when it is called and calls fn with
+// the bets whose agency matches. The log is only appended to, so it is
+// read without holding the lock while other batches are stored
+func (s *LogStore) scan(match func(agency int) bool, fn func(bet *Bet) error) error {
+	s.mu.Lock()
+	size := s.size
+	s.mu.Unlock()
+
+	file, err := s.fs.Open(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to open log: %v", err)
+	}
+	defer file.Close()
+
+	reader := newWalReader(file, size)
+	for {
+		batch, err := nextLogBatch(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for batch.bets.remaining() > 0 {
+			bet, err := batch.bets.next(match)
+			if err != nil {
+				return fmt.Errorf("invalid record at offset %d: %v", reader.start, err)
+			}
+			if bet == nil {
+				continue
+			}
+			if err := fn(bet); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Close Releases the file handle of the store
+func (s *LogStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// encodeLogRecord Returns the record holding the bets of the batch stored
+// after the record whose digest is prev, along with its own digest
+func encodeLogRecord(prev chainHash, agency int, seq uint32, bets []*Bet) ([]byte, chainHash, error) {
+	body := make([]byte, len(prev), len(prev)+logBatchHeaderSize)
+	body = binary.BigEndian.AppendUint32(body, uint32(agency))
+	body = binary.BigEndian.AppendUint32(body, seq)
+	body = binary.BigEndian.AppendUint32(body, uint32(len(bets)))
+
+	for _, bet := range bets {
+		body = binary.BigEndian.AppendUint32(body, uint32(bet.agency))
+		for _, field := range []string{bet.first_name, bet.last_name, bet.document, bet.birthdate.Format(time.DateOnly)} {
+			if len(field) > math.MaxUint16 {
+				return nil, chainHash{}, fmt.Errorf("field too long: %d bytes", len(field))
+			}
+			body = binary.BigEndian.AppendUint16(body, uint16(len(field)))
+			body = append(body, field...)
+		}
+		body = binary.BigEndian.AppendUint32(body, uint32(bet.number))
+	}
+
+	chain := nextChainHash(prev, body[len(prev):])
+	copy(body, chain[:])
+	record, err := appendWalRecord(nil, body)
+	return record, chain, err
+}
+
+// logBatch Batch held by a record of the log
+type logBatch struct {
+	agency int
+	seq    uint32
+	// chain Digest of the record
+	chain chainHash
+	// chained Part of the body the digest is taken over
+	chained []byte
+	bets    *logBets
+}
+
+// nextLogBatch Reads the next record of the log, returning its batch with
+// the bets still to be decoded. io.EOF is returned once every record was
+// read
+func nextLogBatch(reader *walReader) (*logBatch, error) {
+	body, err := reader.next()
+	if err != nil {
+		return nil, err
+	}
+	batch := &logBatch{}
+	if len(body) < len(batch.chain)+logBatchHeaderSize {
+		return nil, fmt.Errorf("invalid record at offset %d: too short", reader.start)
+	}
+	copy(batch.chain[:], body)
+	batch.chained = body[len(batch.chain):]
+	batch.agency = int(binary.BigEndian.Uint32(batch.chained))
+	batch.seq = binary.BigEndian.Uint32(batch.chained[logUint32Size:])
+	count := binary.BigEndian.Uint32(batch.chained[2*logUint32Size:])
+	batch.bets = &logBets{buf: batch.chained[logBatchHeaderSize:], count: count}
+	return batch, nil
+}
+
+// logBets Bets of a record still to be decoded
+type logBets struct {
+	buf   []byte
+	count uint32
+	err   error
+}
+
+func (b *logBets) remaining() uint32 {
+	return b.count
+}
+
+// next Decodes the next bet of the record. Nil is returned without error
+// for a bet whose agency does not match
+func (b *logBets) next(match func(agency int) bool) (*Bet, error) {
+	b.count--
+	agency := int(b.uint32())
+	firstName := b.string()
+	lastName := b.string()
+	document := b.string()
+	birthdate := b.string()
+	number := b.uint32()
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.count == 0 && len(b.buf) > 0 {
+		return nil, fmt.Errorf("%d bytes after the last bet", len(b.buf))
+	}
+	if !match(agency) {
+		return nil, nil
+	}
+
+	date, err := time.Parse(time.DateOnly, birthdate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid birthdate: %v", err)
+	}
+	return &Bet{
+		agency:     agency,
+		first_name: firstName,
+		last_name:  lastName,
+		document:   document,
+		birthdate:  date,
+		number:     int(number),
+	}, nil
+}
+
+func (b *logBets) uint32() uint32 {
+	if b.err != nil || len(b.buf) < logUint32Size {
+		b.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint32(b.buf)
+	b.buf = b.buf[logUint32Size:]
+	return v
+}
+
+func (b *logBets) string() string {
+	if b.err != nil || len(b.buf) < logStringSize {
+		b.fail()
+		return ""
+	}
+	length := int(binary.BigEndian.Uint16(b.buf))
+	if len(b.buf) < logStringSize+length {
+		b.fail()
+		return ""
+	}
+	s := string(b.buf[logStringSize : logStringSize+length])
+	b.buf = b.buf[logStringSize+length:]
+	return s
+}
+
+func (b *logBets) fail() {
+	if b.err == nil {
+		b.err = errors.New("record ends in the middle of a bet")
+	}
+}
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogStoreDiscardsTornRecordOnReopen(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	store := openTestStore(t, fs, StorageLog)
+	_, err := store.StoreBatch(1, 1, testBets(1, 1, 3))
+	assert.Nil(t, err)
+	assert.Nil(t, store.Close())
+	committed, err := afero.ReadFile(fs, testStorePath)
+	assert.Nil(t, err)
+
+	record, _, err := encodeLogRecord(chainHash{}, 1, 2, testBets(1, 2, 3))
+	assert.Nil(t, err)
+
+	// A crash while appending the record of the second batch may leave any
+	// prefix of it, which is removed the next time the log is opened
+	for cut := 1; cut < len(record); cut++ {
+		assert.Nil(t, afero.WriteFile(fs, testStorePath, append(committed, record[:cut]...), 0644))
+
+		store = openTestStore(t, fs, StorageLog)
+		content, err := afero.ReadFile(fs, testStorePath)
+		assert.Nil(t, err)
+		assert.Equal(t, committed, content, "cut at %d", cut)
+
+		// The batch was never acknowledged, so the client sends it again
+		stored, err := store.StoreBatch(1, 2, testBets(1, 2, 3))
+		assert.Nil(t, err)
+		assert.True(t, stored, "cut at %d", cut)
+		bets, err := LoadBets(store)
+		assert.Nil(t, err)
+		assert.Equal(t, append(testBets(1, 1, 3), testBets(1, 2, 3)...), bets)
+		assert.Nil(t, store.Close())
+	}
+}
+
+func TestLogStoreKeepsFieldsWithSeparators(t *testing.T) {
+	store := openTestStore(t, afero.NewMemMapFs(), StorageLog)
+	defer store.Close()
+
+	bets := testBets(1, 1, 2)
+	bets[0].first_name = "first,\n\"quoted\""
+	bets[1].last_name = ""
+	assert.Nil(t, StoreBets(store, bets))
+
+	stored, err := LoadBets(store)
+	assert.Nil(t, err)
+	assert.Equal(t, bets, stored)
+}
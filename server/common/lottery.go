@@ -0,0 +1,172 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared/protocol"
+)
+
+// lottery Holds the draw back until every agency of the registry finished
+// submitting bets, and keeps its outcome afterwards
+type lottery struct {
+	mu       sync.Mutex
+	store    BetStore
+	registry *Registry
+	// seed Secret the winning number is derived from, see Draw
+	seed   []byte
+	prizes PrizeTable
+	// fs and recordPath Where the draw record is written
+	fs         afero.Fs
+	recordPath string
+	// result Outcome of the draw, nil until it takes place
+	result *Draw
+}
+
+func newLottery(store BetStore, registry *Registry, seed []byte, prizes PrizeTable, fs afero.Fs, recordPath string) *lottery {
+	return &lottery{
+		store:      store,
+		registry:   registry,
+		seed:       seed,
+		prizes:     prizes,
+		fs:         fs,
+		recordPath: recordPath,
+	}
+}
+
+// restore Takes back the draw recorded by a previous run, if any. The draw
+// must verify against the store, and every agency is recorded as finished
+// so no more bets are taken and the published draw is never drawn again
+func (l *lottery) restore() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	draw, err := ReadDraw(l.fs, l.recordPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if draw.Commitment != drawCommitment(l.seed) {
+		return fmt.Errorf("draw record at %s was committed to another seed", l.recordPath)
+	}
+	if err := draw.verify(l.store.EachBet); err != nil {
+		return fmt.Errorf("draw record at %s does not match the store: %w", l.recordPath, err)
+	}
+
+	l.registry.FinishAll()
+	l.result = draw
+	log.Infof("action: restaurar_sorteo | result: success | apuestas: %d | numero: %d", draw.Bets, draw.Number)
+	return nil
+}
+
+// storeBatch Stores the batch of the agency, see BetStore.StoreBatch,
+// unless the agency already finished. The check and the write run under
+// the lock the draw takes, so no bet is stored once the draw started
+func (l *lottery) storeBatch(agency int, seq uint32, bets []*Bet) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.registry.CanSubmit(agency); err != nil {
+		return false, err
+	}
+	stored, err := l.store.StoreBatch(agency, seq, bets)
+	if err != nil || !stored {
+		return false, err
+	}
+	return true, l.registry.Submitted(agency, len(bets))
+}
+
+// finish Records that the agency submitted all of its bets. Once every
+// expected agency has finished, the draw takes place
+func (l *lottery) finish(agency int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.registry.Finished(agency); err != nil {
+		return err
+	}
+	if l.result != nil || !l.registry.AllFinished() {
+		return nil
+	}
+
+	return l.draw()
+}
+
+// draw Draws the winning number, see Draw, and goes over every stored bet
+// counting the ones that won each prize. The outcome is only kept once the
+// draw record is written, after which the status of every agency is logged
+// along with its winners. Must be called with the lock held
+func (l *lottery) draw() error {
+	draw, err := NewDraw(l.seed, l.store, l.prizes)
+	if err != nil {
+		log.Errorf("action: sorteo | result: fail | error: %s", err)
+		return fmt.Errorf("could not load bets: %v", err)
+	}
+
+	tierWinners := make([]int, len(draw.Prizes))
+	agencyWinners := make(map[int]int)
+	err = l.store.EachBet(func(bet *Bet) error {
+		if prize := bet.Prize(draw); prize.Won() {
+			tierWinners[prize.Rank]++
+			agencyWinners[bet.agency]++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("action: sorteo | result: fail | error: %s", err)
+		return fmt.Errorf("could not load bets: %v", err)
+	}
+
+	if err := WriteDraw(l.fs, l.recordPath, draw); err != nil {
+		log.Errorf("action: sorteo | result: fail | error: %s", err)
+		return fmt.Errorf("could not record draw: %v", err)
+	}
+	l.result = draw
+
+	tiers := make([]string, 0, len(draw.Prizes))
+	for rank, tier := range draw.Prizes {
+		tiers = append(tiers, fmt.Sprintf("%s=%d", tier.Name, tierWinners[rank]))
+	}
+	log.Infof("action: sorteo | result: success | apuestas: %d | numero: %d | ganadores: %s | semilla: %s | digest_apuestas: %s", draw.Bets, draw.Number, strings.Join(tiers, " "), draw.Seed, draw.BetsDigest)
+	for _, status := range l.registry.Snapshot() {
+		log.Infof("action: sorteo_agencia | result: success | agencia: %d | estado: %s | apuestas: %d | ganadores: %d",
+			status.Agency,
+			status.State,
+			status.Bets,
+			agencyWinners[status.Agency],
+		)
+	}
+	return nil
+}
+
+// agencyWinners Goes over the bets of the agency returning the ones that
+// won a prize along with the tier they won. The second value is false
+// while the draw has not taken place. No bets are stored once it did, see
+// storeBatch, so the scan needs no lock
+func (l *lottery) agencyWinners(agency int) ([]protocol.Winner, bool, error) {
+	l.mu.Lock()
+	draw := l.result
+	l.mu.Unlock()
+
+	if draw == nil {
+		return nil, false, nil
+	}
+	winners := make([]protocol.Winner, 0)
+	err := l.store.EachAgencyBet(agency, func(bet *Bet) error {
+		if prize := bet.Prize(draw); prize.Won() {
+			winners = append(winners, protocol.Winner{Document: bet.document, Tier: prize.Tier})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, true, err
+	}
+	return winners, true, nil
+}
@@ -0,0 +1,67 @@
+package common
+
+import "sync"
+
+// MemoryStore Storage of bets in memory, lost once the server stops. Meant
+// for tests and runs where the bets do not have to outlive the draw
+type MemoryStore struct {
+	mu        sync.Mutex
+	bets      []*Bet
+	sequences batchSequences
+}
+
+// NewMemoryStore Creates an empty store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sequences: make(batchSequences)}
+}
+
+// StoreBatch Appends the bets of the batch, see BetStore
+func (s *MemoryStore) StoreBatch(agency int, seq uint32, bets []*Bet) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sequences.isDuplicate(agency, seq) {
+		return false, nil
+	}
+	for _, bet := range bets {
+		stored := *bet
+		s.bets = append(s.bets, &stored)
+	}
+	s.sequences.stored(agency, seq)
+	return true, nil
+}
+
+// EachBet Calls fn with every stored bet, see BetStore
+func (s *MemoryStore) EachBet(fn func(bet *Bet) error) error {
+	return s.scan(func(int) bool { return true }, fn)
+}
+
+// EachAgencyBet Calls fn with every stored bet of the agency, see BetStore
+func (s *MemoryStore) EachAgencyBet(agency int, fn func(bet *Bet) error) error {
+	return s.scan(func(betAgency int) bool { return betAgency == agency }, fn)
+}
+
+// scan Calls fn with a copy of every bet stored when it is called whose
+// agency matches. Stored bets are never modified, so they are gone over
+// without holding the lock while other batches are stored
+func (s *MemoryStore) scan(match func(agency int) bool, fn func(bet *Bet) error) error {
+	s.mu.Lock()
+	bets := s.bets
+	s.mu.Unlock()
+
+	for _, bet := range bets {
+		if !match(bet.agency) {
+			continue
+		}
+		scanned := *bet
+		if err := fn(&scanned); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close Does nothing, the bets are kept until the store is released
+func (s *MemoryStore) Close() error {
+	return nil
+}
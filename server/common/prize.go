@@ -0,0 +1,86 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxBetDigits Digits of the highest number a bet can be placed on, a
+// tier matching all of them pays exact matches
+const maxBetDigits = 4
+
+// PrizeTier Prize paid to the bets whose number ends in the same Digits
+// digits as the winning number, numbers being padded with zeros to
+// maxBetDigits digits
+type PrizeTier struct {
+	Name   string `json:"name"`
+	Digits int    `json:"digits"`
+}
+
+// matches Reports whether a bet on number wins the tier when winning is
+// drawn
+func (t PrizeTier) matches(number int, winning int) bool {
+	modulus := 1
+	for i := 0; i < t.Digits; i++ {
+		modulus *= 10
+	}
+	return number%modulus == winning%modulus
+}
+
+// PrizeTable Tiers of a draw from the highest prize to the lowest, each
+// matching fewer digits than the one before it. A bet only wins the
+// highest tier it matches
+type PrizeTable []PrizeTier
+
+// ParsePrizeTiers Parses a comma separated list of name:digits tiers, such
+// as "exact:4,last3:3,last2:2", from the highest prize to the lowest
+func ParsePrizeTiers(list string) (PrizeTable, error) {
+	table := make(PrizeTable, 0)
+	names := make(map[string]bool)
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, digits, found := strings.Cut(item, ":")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid prize tier %q, expected name:digits", item)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicated prize tier %q", name)
+		}
+		tier := PrizeTier{Name: name}
+		var err error
+		tier.Digits, err = strconv.Atoi(strings.TrimSpace(digits))
+		if err != nil || tier.Digits < 1 || tier.Digits > maxBetDigits {
+			return nil, fmt.Errorf("prize tier %q must match between 1 and %d digits", name, maxBetDigits)
+		}
+		if len(table) > 0 && tier.Digits >= table[len(table)-1].Digits {
+			return nil, fmt.Errorf("prize tier %q must match fewer digits than %q", name, table[len(table)-1].Name)
+		}
+		names[name] = true
+		table = append(table, tier)
+	}
+
+	if len(table) == 0 {
+		return nil, fmt.Errorf("no prize tiers given")
+	}
+	return table, nil
+}
+
+// Prize Result of a bet in a draw: the tier it won, if any
+type Prize struct {
+	// Tier Name of the tier won, empty for bets that won no prize
+	Tier string
+	// Rank Position of the tier in the prize table, 0 being the highest
+	// prize
+	Rank int
+}
+
+// Won Reports whether the bet won a prize
+func (p Prize) Won() bool {
+	return p.Tier != ""
+}
@@ -0,0 +1,54 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePrizeTiersKeepsTheOrderOfTheList(t *testing.T) {
+	prizes, err := ParsePrizeTiers("exact:4, last3 : 3,last1:1")
+	assert.Nil(t, err)
+	assert.Equal(t, PrizeTable{
+		{Name: "exact", Digits: 4},
+		{Name: "last3", Digits: 3},
+		{Name: "last1", Digits: 1},
+	}, prizes)
+}
+
+func TestParsePrizeTiersRejectsInvalidTables(t *testing.T) {
+	for _, list := range []string{
+		"",
+		"exact",
+		":4",
+		"exact:x",
+		"exact:0",
+		"exact:5",
+		"exact:4,exact:2",
+		"last2:2,last3:3",
+		"last2:2,other:2",
+	} {
+		_, err := ParsePrizeTiers(list)
+		assert.NotNil(t, err, list)
+	}
+}
+
+func TestPrizeIsTheHighestTierMatched(t *testing.T) {
+	prizes, err := ParsePrizeTiers("exact:4,last3:3,last2:2")
+	assert.Nil(t, err)
+	draw := &Draw{Number: 1007, Prizes: prizes}
+
+	cases := map[string]Prize{
+		"1007": {Tier: "exact", Rank: 0},
+		"2007": {Tier: "last3", Rank: 1},
+		"7":    {Tier: "last3", Rank: 1},
+		"107":  {Tier: "last2", Rank: 2},
+		"1070": {},
+		"17":   {},
+	}
+	for number, expected := range cases {
+		bet, err := NewBet("1", "first", "last", "10000000", "2000-12-20", number)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, bet.Prize(draw), number)
+	}
+}
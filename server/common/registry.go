@@ -0,0 +1,220 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnknownAgency  = errors.New("unknown agency")
+	ErrAgencyFinished = errors.New("agency already finished submitting bets")
+)
+
+// AgencyState Progress of an agency through the lottery intake
+type AgencyState int
+
+const (
+	// AgencyPending The agency has not contacted the server yet
+	AgencyPending AgencyState = iota
+	// AgencyConnected The agency contacted the server but sent no bets yet
+	AgencyConnected
+	// AgencySubmitting The agency has bets stored and may send more
+	AgencySubmitting
+	// AgencyFinished The agency notified it has no more bets to submit
+	AgencyFinished
+)
+
+func (s AgencyState) String() string {
+	switch s {
+	case AgencyPending:
+		return "pending"
+	case AgencyConnected:
+		return "connected"
+	case AgencySubmitting:
+		return "submitting"
+	case AgencyFinished:
+		return "finished"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// AgencyStatus Snapshot of the state of an agency and the amount of bets
+// stored for it
+type AgencyStatus struct {
+	Agency int
+	State  AgencyState
+	Bets   int
+}
+
+// Registry Roster of the agencies expected to take part in the lottery,
+// tracking which of them connected, submitted bets and finished. It is
+// safe for concurrent use
+type Registry struct {
+	mu       sync.Mutex
+	agencies map[int]*AgencyStatus
+}
+
+// NewRegistry Creates a registry expecting exactly the given agencies
+func NewRegistry(agencies []int) *Registry {
+	registry := &Registry{agencies: make(map[int]*AgencyStatus)}
+	for _, agency := range agencies {
+		registry.agencies[agency] = &AgencyStatus{Agency: agency, State: AgencyPending}
+	}
+	return registry
+}
+
+// ParseAgencies Returns the roster described by the configuration. An
+// explicit comma separated list of IDs takes precedence over an amount,
+// which stands for the agencies 1 to amount
+func ParseAgencies(list string, amount int) ([]int, error) {
+	if strings.TrimSpace(list) == "" {
+		if amount <= 0 {
+			return nil, errors.New("no agencies configured")
+		}
+		agencies := make([]int, 0, amount)
+		for agency := 1; agency <= amount; agency++ {
+			agencies = append(agencies, agency)
+		}
+		return agencies, nil
+	}
+
+	seen := make(map[int]bool)
+	agencies := make([]int, 0)
+	for _, field := range strings.Split(list, ",") {
+		agency, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid agency %q: %v", field, err)
+		}
+		if seen[agency] {
+			return nil, fmt.Errorf("duplicated agency %d", agency)
+		}
+		seen[agency] = true
+		agencies = append(agencies, agency)
+	}
+	return agencies, nil
+}
+
+// Connected Records that the agency contacted the server
+func (r *Registry) Connected(agency int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status, ok := r.agencies[agency]
+	if !ok {
+		return ErrUnknownAgency
+	}
+	if status.State == AgencyPending {
+		r.transition(status, AgencyConnected)
+	}
+	return nil
+}
+
+// CanSubmit Checks that the agency is expected and still accepting bets
+func (r *Registry) CanSubmit(agency int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status, ok := r.agencies[agency]
+	if !ok {
+		return ErrUnknownAgency
+	}
+	if status.State == AgencyFinished {
+		return ErrAgencyFinished
+	}
+	return nil
+}
+
+// Submitted Records that bets of the agency were stored
+func (r *Registry) Submitted(agency int, bets int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status, ok := r.agencies[agency]
+	if !ok {
+		return ErrUnknownAgency
+	}
+	status.Bets += bets
+	if status.State != AgencySubmitting && status.State != AgencyFinished {
+		r.transition(status, AgencySubmitting)
+	}
+	return nil
+}
+
+// Finished Records that the agency has no more bets to submit
+func (r *Registry) Finished(agency int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status, ok := r.agencies[agency]
+	if !ok {
+		return ErrUnknownAgency
+	}
+	if status.State != AgencyFinished {
+		r.transition(status, AgencyFinished)
+	}
+	return nil
+}
+
+// FinishAll Records that every expected agency has finished, used once the
+// draw already took place
+func (r *Registry) FinishAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, status := range r.agencies {
+		if status.State != AgencyFinished {
+			r.transition(status, AgencyFinished)
+		}
+	}
+}
+
+// AllFinished Returns true once every expected agency has finished
+func (r *Registry) AllFinished() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, status := range r.agencies {
+		if status.State != AgencyFinished {
+			return false
+		}
+	}
+	return true
+}
+
+// Snapshot Returns the status of every expected agency sorted by ID
+func (r *Registry) Snapshot() []AgencyStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	snapshot := make([]AgencyStatus, 0, len(r.agencies))
+	for _, status := range r.agencies {
+		snapshot = append(snapshot, *status)
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Agency < snapshot[j].Agency })
+	return snapshot
+}
+
+// transition Moves the agency to a new state logging the change. Must be
+// called with the lock held
+func (r *Registry) transition(status *AgencyStatus, state AgencyState) {
+	status.State = state
+
+	finished := 0
+	for _, other := range r.agencies {
+		if other.State == AgencyFinished {
+			finished++
+		}
+	}
+	log.Infof("action: estado_agencia | result: success | agencia: %d | estado: %s | apuestas: %d | agencias_finalizadas: %d/%d",
+		status.Agency,
+		state,
+		status.Bets,
+		finished,
+		len(r.agencies),
+	)
+}
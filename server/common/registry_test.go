@@ -0,0 +1,56 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAgenciesPrefersExplicitList(t *testing.T) {
+	agencies, err := ParseAgencies("3, 7,9", 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{3, 7, 9}, agencies)
+
+	agencies, err = ParseAgencies("", 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 2, 3}, agencies)
+}
+
+func TestParseAgenciesRejectsInvalidRosters(t *testing.T) {
+	_, err := ParseAgencies("", 0)
+	assert.NotNil(t, err)
+
+	_, err = ParseAgencies("1,x", 0)
+	assert.NotNil(t, err)
+
+	_, err = ParseAgencies("1,2,1", 0)
+	assert.NotNil(t, err)
+}
+
+func TestRegistryTracksAgenciesUntilAllFinished(t *testing.T) {
+	registry := NewRegistry([]int{1, 2})
+
+	assert.Nil(t, registry.Connected(1))
+	assert.Nil(t, registry.Submitted(1, 10))
+	assert.Nil(t, registry.Submitted(1, 5))
+	assert.Nil(t, registry.Finished(1))
+	assert.False(t, registry.AllFinished())
+	assert.ErrorIs(t, registry.CanSubmit(1), ErrAgencyFinished)
+
+	assert.Equal(t, []AgencyStatus{
+		{Agency: 1, State: AgencyFinished, Bets: 15},
+		{Agency: 2, State: AgencyPending, Bets: 0},
+	}, registry.Snapshot())
+
+	assert.Nil(t, registry.Finished(2))
+	assert.True(t, registry.AllFinished())
+}
+
+func TestRegistryRejectsUnknownAgencies(t *testing.T) {
+	registry := NewRegistry([]int{1})
+
+	assert.ErrorIs(t, registry.Connected(2), ErrUnknownAgency)
+	assert.ErrorIs(t, registry.CanSubmit(2), ErrUnknownAgency)
+	assert.ErrorIs(t, registry.Submitted(2, 1), ErrUnknownAgency)
+	assert.ErrorIs(t, registry.Finished(2), ErrUnknownAgency)
+}
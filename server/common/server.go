@@ -1,65 +1,534 @@
 package common
 
 import (
-	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/op/go-logging"
+	"github.com/spf13/afero"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared/protocol"
 )
 
 var log = logging.MustGetLogger("log")
 
+const (
+	// shutdownTimeout How long a shutdown waits for in-flight handlers
+	// before closing their connections
+	shutdownTimeout = 500 * time.Millisecond
+)
+
+// Config Server configuration parameters, read from config.ini and
+// overridden by env variables
+type Config struct {
+	ServerPort          int    `mapstructure:"SERVER_PORT"`
+	ServerIp            string `mapstructure:"SERVER_IP"`
+	ServerListenBacklog int    `mapstructure:"SERVER_LISTEN_BACKLOG"`
+	ServerReuseAddr     bool   `mapstructure:"SERVER_REUSE_ADDR"`
+	ServerReusePort     bool   `mapstructure:"SERVER_REUSE_PORT"`
+	ServerMaxClients    int    `mapstructure:"SERVER_MAX_CLIENTS"`
+	// ServerReadTimeout Time a client has to send a whole message once it
+	// started sending it, and to send the hello after connecting
+	ServerReadTimeout time.Duration `mapstructure:"SERVER_READ_TIMEOUT"`
+	// ServerWriteTimeout Time a client has to take a whole reply
+	ServerWriteTimeout time.Duration `mapstructure:"SERVER_WRITE_TIMEOUT"`
+	// ServerIdleTimeout Time a session may wait for the next request
+	// before it is closed
+	ServerIdleTimeout time.Duration `mapstructure:"SERVER_IDLE_TIMEOUT"`
+	AgenciesAmount    int           `mapstructure:"AGENCIES_AMOUNT"`
+	Agencies          string        `mapstructure:"AGENCIES"`
+	// AgenciesKeysFile Path of the file holding the secret of every
+	// agency, see shared.LoadKeys
+	AgenciesKeysFile string `mapstructure:"AGENCIES_KEYS_FILE"`
+	// ServerTlsEnabled Serves every connection over TLS using the PEM
+	// certificate and key at ServerTlsCert and ServerTlsKey. When
+	// ServerTlsRequireClientCert is set agencies must present a
+	// certificate signed by the CA at ServerTlsCa
+	ServerTlsEnabled           bool   `mapstructure:"SERVER_TLS_ENABLED"`
+	ServerTlsCert              string `mapstructure:"SERVER_TLS_CERT"`
+	ServerTlsKey               string `mapstructure:"SERVER_TLS_KEY"`
+	ServerTlsCa                string `mapstructure:"SERVER_TLS_CA"`
+	ServerTlsRequireClientCert bool   `mapstructure:"SERVER_TLS_REQUIRE_CLIENT_CERT"`
+	// StorageType Kind of store keeping the bets, one of StorageCSV,
+	// StorageLog or StorageMemory. StoragePath is where file based stores
+	// keep them
+	StorageType string `mapstructure:"STORAGE_TYPE"`
+	StoragePath string `mapstructure:"STORAGE_PATH"`
+	// DrawSeedPath File keeping the secret seed of the draw, created with
+	// a random one if it does not exist. DrawRecordPath is where the draw
+	// is recorded once it takes place, see Draw
+	DrawSeedPath   string `mapstructure:"DRAW_SEED_PATH"`
+	DrawRecordPath string `mapstructure:"DRAW_RECORD_PATH"`
+	// PrizeTiers Prize table of the draw, see ParsePrizeTiers
+	PrizeTiers   string `mapstructure:"PRIZE_TIERS"`
+	LoggingLevel string `mapstructure:"LOGGING_LEVEL"`
+}
+
 type Server struct {
 	serverSocket *net.TCPListener
+	registry     *Registry
+	lottery      *lottery
+	// keys Secret of every expected agency, used to authenticate sessions
+	keys map[int][]byte
+	// tlsConfig Used to serve the connections over TLS, nil when disabled
+	tlsConfig *tls.Config
+	// readTimeout, writeTimeout and idleTimeout Deadlines applied to the
+	// socket operations of every connection, see Config
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+	// slots Bounds how many connections are handled at the same time, a
+	// handler takes a slot before the connection is accepted and releases
+	// it once the connection is closed
+	slots chan struct{}
+
+	// done Closed once a shutdown has been requested
+	done         chan struct{}
+	shutdownOnce sync.Once
+	handlers     sync.WaitGroup
+
+	// conns Connections being handled, closed if their handlers do not
+	// finish in time during a shutdown
+	connsLock sync.Mutex
+	conns     map[*net.TCPConn]struct{}
 }
 
-func NewServer(port int, listenBacklog int) (*Server, error) {
-	serverSocket, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+func NewServer(config Config, store BetStore) (*Server, error) {
+	agencies, err := ParseAgencies(config.Agencies, config.AgenciesAmount)
+	if err != nil {
+		return nil, err
+	}
+	registry := NewRegistry(agencies)
+
+	prizes, err := ParsePrizeTiers(config.PrizeTiers)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Server{serverSocket: serverSocket}, nil
+	keys, err := loadAgencyKeys(config.AgenciesKeysFile, agencies)
+	if err != nil {
+		return nil, err
+	}
+
+	// The commitment is published before any bet is taken
+	fs := afero.NewOsFs()
+	seed, err := loadDrawSeed(fs, config.DrawSeedPath)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("action: compromiso_sorteo | result: success | commitment: %s", drawCommitment(seed))
+
+	// A draw recorded before a restart is kept, closing intake
+	lottery := newLottery(store, registry, seed, prizes, fs, config.DrawRecordPath)
+	if err := lottery.restore(); err != nil {
+		return nil, err
+	}
+
+	var tlsConfig *tls.Config
+	if config.ServerTlsEnabled {
+		tlsConfig, err = shared.ServerTLSConfig(
+			config.ServerTlsCert,
+			config.ServerTlsKey,
+			config.ServerTlsCa,
+			config.ServerTlsRequireClientCert,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	serverSocket, err := listenTCP(
+		config.ServerIp,
+		config.ServerPort,
+		config.ServerListenBacklog,
+		config.ServerReuseAddr,
+		config.ServerReusePort,
+	)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("action: listen | result: success | address: %s | backlog: %d | tls: %t", serverSocket.Addr(), config.ServerListenBacklog, tlsConfig != nil)
+
+	return &Server{
+		serverSocket: serverSocket,
+		registry:     registry,
+		lottery:      lottery,
+		keys:         keys,
+		tlsConfig:    tlsConfig,
+		readTimeout:  config.ServerReadTimeout,
+		writeTimeout: config.ServerWriteTimeout,
+		idleTimeout:  config.ServerIdleTimeout,
+		slots:        make(chan struct{}, config.ServerMaxClients),
+		done:         make(chan struct{}),
+		conns:        make(map[*net.TCPConn]struct{}),
+	}, nil
 }
 
-// Dummy Server loop
+// Addr Returns the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.serverSocket.Addr()
+}
 
-// Server that accept a new connections and establishes a
-// communication with a client. After client with communucation
-// finishes, servers starts to accept new connections again
+// Server that accept new connections and handles each of them in its own
+// goroutine. At most ServerMaxClients connections are handled at the same
+// time, once that limit is reached new connections wait in the listen
+// backlog until a handler finishes. Run returns after Shutdown is called,
+// once every in-flight handler has finished
 func (s *Server) Run() {
 	for {
+		select {
+		case s.slots <- struct{}{}:
+		case <-s.done:
+			s.waitHandlers()
+			return
+		}
+
 		clientSocket, err := s.acceptNewConnection()
 		if err != nil {
+			<-s.slots
+			if s.shuttingDown() {
+				s.waitHandlers()
+				return
+			}
 			log.Errorf("action: accept_connections | result: fail | error: %s", err)
 			continue
 		}
-		s.handleClientConnection(clientSocket)
+
+		s.trackConnection(clientSocket)
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			defer func() { <-s.slots }()
+			defer s.untrackConnection(clientSocket)
+			s.handleClientConnection(clientSocket)
+		}()
+	}
+}
+
+// Shutdown Stops accepting new connections and makes Run return once the
+// in-flight handlers finish. It is safe to call it more than once
+func (s *Server) Shutdown() {
+	s.shutdownOnce.Do(func() {
+		log.Info("action: shutdown | result: in_progress")
+		close(s.done)
+		s.serverSocket.Close()
+	})
+}
+
+func (s *Server) shuttingDown() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitHandlers Waits for the in-flight handlers. Handlers still running
+// after shutdownTimeout get their connections closed, a handler storing
+// bets still finishes its write since the store is not interrupted
+func (s *Server) waitHandlers() {
+	finished := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(shutdownTimeout):
+		log.Warning("action: shutdown | result: in_progress | msg: closing connections of unfinished handlers")
+		s.connsLock.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.connsLock.Unlock()
+		<-finished
 	}
 }
 
-// Read message from a specific client socket and closes the socket
+func (s *Server) trackConnection(conn *net.TCPConn) {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	s.conns[conn] = struct{}{}
+}
+
+func (s *Server) untrackConnection(conn *net.TCPConn) {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	delete(s.conns, conn)
+}
+
+// session State of a connection opened by an agency
+type session struct {
+	agency int
+	addr   net.Addr
+}
+
+// Handles the session of an agency. The first message must be a hello
+// identifying the agency, afterwards requests are read and answered on the
+// same connection until the client says goodbye, closes it or stays idle
+// for longer than the idle timeout. A client that stalls while sending a
+// message or taking a reply is dropped once the read or write timeout
+// expires, so it only ever holds its own slot
 
 // If a problem arises in the communication with the client, the
 // client socket will also be closed
-func (s *Server) handleClientConnection(clientSocket *net.TCPConn) {
+func (s *Server) handleClientConnection(tcpSocket *net.TCPConn) {
+	defer tcpSocket.Close()
+
+	clientSocket, err := s.secureConnection(tcpSocket)
+	if err != nil {
+		logConnectionError("tls_handshake", fmt.Sprintf("ip: %s", tcpSocket.RemoteAddr()), err)
+		return
+	}
 	defer clientSocket.Close()
 
-	msg, err := bufio.NewReader(clientSocket).ReadString('\n')
+	session, err := s.openSession(clientSocket)
 	if err != nil {
-		log.Error("Error reading client message: %s", err)
+		logConnectionError("open_session", fmt.Sprintf("ip: %s", clientSocket.RemoteAddr()), err)
 		return
 	}
-	log.Infof("action: receive_message | result: success | ip: %s | msg: %s", clientSocket.RemoteAddr(), msg)
+	log.Infof("action: open_session | result: success | ip: %s | agencia: %d", session.addr, session.agency)
 
-	// TODO: Modify the send to avoid short-write
-	fmt.Fprintf(
-		clientSocket,
-		msg,
-	)
+	for !s.shuttingDown() {
+		msg, err := shared.AwaitMessage(clientSocket, s.idleTimeout, s.readTimeout)
+		if errors.Is(err, io.EOF) {
+			log.Infof("action: close_session | result: success | agencia: %d | msg: closed by client", session.agency)
+			return
+		}
+		if errors.Is(err, shared.ErrIdleTimeout) {
+			log.Warningf("action: close_session | result: success | agencia: %d | msg: idle for %v", session.agency, s.idleTimeout)
+			return
+		}
+		if err != nil {
+			logConnectionError("receive_message", fmt.Sprintf("agencia: %d", session.agency), err)
+			return
+		}
+
+		if msg.Type == protocol.MessageGoodbye {
+			log.Infof("action: close_session | result: success | agencia: %d", session.agency)
+			return
+		}
+
+		reply := s.handleMessage(session, msg)
+
+		if err := shared.SendMessage(clientSocket, reply, s.writeTimeout); err != nil {
+			logConnectionError("send_message", fmt.Sprintf("agencia: %d", session.agency), err)
+			return
+		}
+	}
+}
+
+// logConnectionError Logs a failed socket operation, telling apart peers
+// that stopped responding from peers that dropped the connection
+func logConnectionError(action string, peer string, err error) {
+	switch {
+	case shared.IsTimeout(err):
+		log.Warningf("action: %s | result: fail | %s | error: timeout", action, peer)
+	case shared.IsReset(err):
+		log.Warningf("action: %s | result: fail | %s | error: connection reset by peer", action, peer)
+	default:
+		log.Errorf("action: %s | result: fail | %s | error: %s", action, peer, err)
+	}
+}
 
-	// clientSocket.Write(msg)
+// secureConnection Runs the TLS handshake on the accepted connection when
+// TLS is enabled, bounded by the read timeout. The connection is returned
+// as is otherwise
+func (s *Server) secureConnection(tcpSocket *net.TCPConn) (net.Conn, error) {
+	if s.tlsConfig == nil {
+		return tcpSocket, nil
+	}
+	tlsSocket := tls.Server(tcpSocket, s.tlsConfig)
+	if err := tlsSocket.SetDeadline(time.Now().Add(s.readTimeout)); err != nil {
+		return nil, err
+	}
+	if err := tlsSocket.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsSocket, nil
+}
+
+// openSession Reads the hello that must open every session and
+// authenticates the agency it comes from. Once authenticated the session
+// is bound to that agency for every following request. Peers that fail
+// are told why before the connection is closed
+func (s *Server) openSession(clientSocket net.Conn) (*session, error) {
+	msg, err := shared.ReceiveMessage(clientSocket, s.readTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Type != protocol.MessageHello {
+		shared.SendMessage(clientSocket, protocol.NewErrorMessage("session must start with hello"), s.writeTimeout)
+		return nil, fmt.Errorf("unexpected message: %v", msg.Type)
+	}
+
+	agency, err := decodeAgency(msg)
+	if err == nil {
+		err = verifyPeerAgency(clientSocket, agency)
+	}
+	if err == nil {
+		err = s.authenticate(clientSocket, agency)
+	}
+	if err == nil {
+		err = s.registry.Connected(agency)
+	}
+	if err != nil {
+		shared.SendMessage(clientSocket, protocol.NewErrorMessage(err.Error()), s.writeTimeout)
+		return nil, err
+	}
+
+	if err := shared.SendMessage(clientSocket, protocol.NewAckMessage(), s.writeTimeout); err != nil {
+		return nil, err
+	}
+	return &session{agency: agency, addr: clientSocket.RemoteAddr()}, nil
+}
+
+// handleMessage Processes a request received on the session and returns
+// the reply to be sent back to the client
+func (s *Server) handleMessage(session *session, msg protocol.Message) protocol.Message {
+	switch msg.Type {
+	case protocol.MessageBetBatch:
+		return s.handleBetBatch(session, msg)
+	case protocol.MessageBetsFinished:
+		return s.handleBetsFinished(session, msg)
+	case protocol.MessageWinnersQuery:
+		return s.handleWinnersQuery(session, msg)
+	default:
+		return protocol.NewErrorMessage(fmt.Sprintf("unexpected message: %v", msg.Type))
+	}
+}
+
+// handleBetBatch Validates every bet of the batch and stores the valid ones
+// at once, unless the agency finished in the meantime. Invalid bets are
+// left out and reported back with the reason they were rejected for, while
+// a batch that cannot be processed at all is rejected as a whole. A batch
+// whose sequence number was already stored is a retry of the client, it
+// gets the same reply without being stored again
+func (s *Server) handleBetBatch(session *session, msg protocol.Message) protocol.Message {
+	seq, batch, err := protocol.DecodeBetBatch(msg)
+	if err == nil && seq == 0 {
+		err = errors.New("batch sequence numbers start at 1")
+	}
+	if err != nil {
+		log.Errorf("action: apuesta_recibida | result: fail | agencia: %d | error: %s", session.agency, err)
+		return protocol.NewErrorMessage(err.Error())
+	}
+	if err := s.registry.CanSubmit(session.agency); err != nil {
+		log.Errorf("action: apuesta_recibida | result: fail | cantidad: %d | agencia: %d | error: %s", len(batch), session.agency, err)
+		return protocol.NewErrorMessage(fmt.Sprintf("agency %d: %s", session.agency, err))
+	}
+
+	now := time.Now()
+	bets := make([]*Bet, 0, len(batch))
+	rejections := make([]protocol.Rejection, 0)
+	for i, data := range batch {
+		bet, err := ValidateBet(data, session.agency, now)
+		var rejected *RejectedBetError
+		if errors.As(err, &rejected) {
+			log.Debugf("action: apuesta_rechazada | result: success | agencia: %d | dni: %s | motivo: %s", session.agency, data.Document, rejected)
+			rejections = append(rejections, protocol.Rejection{Index: i, Reason: rejected.Reason})
+			continue
+		}
+		bets = append(bets, bet)
+	}
+
+	if len(bets) > 0 {
+		stored, err := s.lottery.storeBatch(session.agency, seq, bets)
+		if errors.Is(err, ErrAgencyFinished) {
+			log.Errorf("action: apuesta_recibida | result: fail | cantidad: %d | agencia: %d | error: %s", len(batch), session.agency, err)
+			return protocol.NewErrorMessage(fmt.Sprintf("agency %d: %s", session.agency, err))
+		}
+		if err != nil {
+			log.Errorf("action: apuesta_recibida | result: fail | cantidad: %d | agencia: %d | error: %s", len(batch), session.agency, err)
+			return protocol.NewErrorMessage("could not store bets")
+		}
+		if stored {
+			log.Infof("action: apuesta_recibida | result: success | cantidad: %d | agencia: %d", len(bets), session.agency)
+		} else {
+			log.Warningf("action: apuesta_recibida | result: success | cantidad: %d | agencia: %d | msg: duplicated batch %d not stored again", len(bets), session.agency, seq)
+		}
+	}
+
+	if len(rejections) == 0 {
+		return protocol.NewAckMessage()
+	}
+	log.Errorf("action: apuesta_recibida | result: fail | cantidad: %d | agencia: %d", len(rejections), session.agency)
+	reply, err := protocol.NewBetsRejectedMessage(rejections)
+	if err != nil {
+		return protocol.NewErrorMessage(err.Error())
+	}
+	return reply
+}
+
+// handleBetsFinished Records that the agency will not submit more bets,
+// triggering the draw if it was the last one
+func (s *Server) handleBetsFinished(session *session, msg protocol.Message) protocol.Message {
+	agency, err := sessionAgency(session, msg)
+	if err != nil {
+		log.Errorf("action: fin_apuestas | result: fail | agencia: %d | error: %s", session.agency, err)
+		return protocol.NewErrorMessage(err.Error())
+	}
+
+	if err := s.lottery.finish(agency); err != nil {
+		log.Errorf("action: fin_apuestas | result: fail | agencia: %d | error: %s", agency, err)
+		return protocol.NewErrorMessage(err.Error())
+	}
+
+	log.Infof("action: fin_apuestas | result: success | agencia: %d", agency)
+	return protocol.NewAckMessage()
+}
+
+// handleWinnersQuery Replies with the winners of the agency and the prize
+// tier each of them won, or with a pending reply if the draw has not taken
+// place yet
+func (s *Server) handleWinnersQuery(session *session, msg protocol.Message) protocol.Message {
+	agency, err := sessionAgency(session, msg)
+	if err != nil {
+		log.Errorf("action: consulta_ganadores | result: fail | agencia: %d | error: %s", session.agency, err)
+		return protocol.NewErrorMessage(err.Error())
+	}
+
+	winners, drawn, err := s.lottery.agencyWinners(agency)
+	if err != nil {
+		log.Errorf("action: consulta_ganadores | result: fail | agencia: %d | error: %s", agency, err)
+		return protocol.NewErrorMessage("could not load winners")
+	}
+	if !drawn {
+		log.Debugf("action: consulta_ganadores | result: in_progress | agencia: %d", agency)
+		return protocol.NewDrawPendingMessage()
+	}
+
+	reply, err := protocol.NewWinnersMessage(winners)
+	if err != nil {
+		log.Errorf("action: consulta_ganadores | result: fail | agencia: %d | error: %s", agency, err)
+		return protocol.NewErrorMessage(err.Error())
+	}
+
+	log.Infof("action: consulta_ganadores | result: success | agencia: %d | cant_ganadores: %d", agency, len(winners))
+	return reply
+}
+
+// decodeAgency Parses the agency carried by MessageHello,
+// MessageBetsFinished and MessageWinnersQuery
+func decodeAgency(msg protocol.Message) (int, error) {
+	data, err := protocol.DecodeAgency(msg)
+	if err != nil {
+		return 0, err
+	}
+	agency, err := strconv.Atoi(data)
+	if err != nil {
+		return 0, fmt.Errorf("invalid agency: %v", err)
+	}
+	return agency, nil
 }
 
 func (s *Server) acceptNewConnection() (*net.TCPConn, error) {
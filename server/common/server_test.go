@@ -0,0 +1,546 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared/protocol"
+)
+
+// startTestServer Runs a server on a random loopback port backed by a CSV
+// store on an in memory filesystem
+func startTestServer(t *testing.T, config Config) (*Server, BetStore) {
+	store := openTestStore(t, afero.NewMemMapFs(), StorageCSV)
+	t.Cleanup(func() { store.Close() })
+
+	server, err := NewServer(config, store)
+	assert.Nil(t, err)
+	go server.Run()
+
+	return server, store
+}
+
+// testConfig Configuration of a test server on a loopback port expecting
+// agencies 1 to agencies, whose secrets are given by testSecret
+func testConfig(t *testing.T, maxClients int, agencies int) Config {
+	keys := ""
+	for agency := 1; agency <= agencies; agency++ {
+		keys += fmt.Sprintf("%d,%s\n", agency, testSecret(agency))
+	}
+	keysFile := filepath.Join(t.TempDir(), "keys.csv")
+	assert.Nil(t, os.WriteFile(keysFile, []byte(keys), 0600))
+
+	return Config{
+		ServerIp:            "127.0.0.1",
+		ServerListenBacklog: 16,
+		ServerMaxClients:    maxClients,
+		ServerReadTimeout:   5 * time.Second,
+		ServerWriteTimeout:  5 * time.Second,
+		ServerIdleTimeout:   5 * time.Second,
+		AgenciesAmount:      agencies,
+		AgenciesKeysFile:    keysFile,
+		DrawSeedPath:        filepath.Join(t.TempDir(), "draw-seed"),
+		DrawRecordPath:      filepath.Join(t.TempDir(), "draw.json"),
+		PrizeTiers:          testPrizeTiers,
+	}
+}
+
+func testSecret(agency int) []byte {
+	return []byte(fmt.Sprintf("secret-%d", agency))
+}
+
+func testBatch(agency int, batch int, size int) []protocol.Bet {
+	bets := make([]protocol.Bet, 0, size)
+	for i := 0; i < size; i++ {
+		bets = append(bets, protocol.Bet{
+			Agency:    strconv.Itoa(agency),
+			FirstName: fmt.Sprintf("first_%d_%d", batch, i),
+			LastName:  "last, with comma",
+			Document:  strconv.Itoa(10000000 + batch*size + i),
+			Birthdate: "2000-12-20",
+			Number:    strconv.Itoa(i),
+		})
+	}
+	return bets
+}
+
+// testSession Session opened against a test server on behalf of an agency
+type testSession struct {
+	conn net.Conn
+	// seq Sequence number of the last batch submitted
+	seq uint32
+}
+
+// openTestSession Connects to the server and authenticates as the agency
+func openTestSession(addr string, agency int) (*testSession, error) {
+	return openTestSessionWithSecret(addr, agency, testSecret(agency))
+}
+
+// openTestSessionWithSecret Connects to the server and answers the
+// challenge of the agency signing it with secret
+func openTestSessionWithSecret(addr string, agency int, secret []byte) (*testSession, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return startTestSession(conn, agency, secret)
+}
+
+// startTestSession Opens a session as the agency on an established
+// connection, closing it if the server rejects the session
+func startTestSession(conn net.Conn, agency int, secret []byte) (*testSession, error) {
+	session := &testSession{conn: conn}
+
+	hello, _ := protocol.NewHelloMessage(strconv.Itoa(agency))
+	reply, err := session.request(hello)
+	if err == nil && reply.Type == protocol.MessageChallenge {
+		nonce, _ := protocol.DecodeChallenge(reply)
+		auth, _ := protocol.NewAuthMessage(protocol.SignChallenge(secret, strconv.Itoa(agency), nonce))
+		reply, err = session.request(auth)
+	}
+	if err == nil && reply.Type != protocol.MessageAck {
+		reason, _ := protocol.DecodeError(reply)
+		err = fmt.Errorf("session rejected: %v %s", reply.Type, reason)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *testSession) request(msg protocol.Message) (protocol.Message, error) {
+	if err := shared.SendMessage(s.conn, msg, time.Second); err != nil {
+		return protocol.Message{}, err
+	}
+	return shared.ReceiveMessage(s.conn, 5*time.Second)
+}
+
+func (s *testSession) submitBatch(bets []protocol.Bet) (protocol.Message, error) {
+	s.seq++
+	msg, err := protocol.NewBetBatchMessage(s.seq, bets)
+	if err != nil {
+		return protocol.Message{}, err
+	}
+	return s.request(msg)
+}
+
+func (s *testSession) close() {
+	shared.SendMessage(s.conn, protocol.NewGoodbyeMessage(), time.Second)
+	s.conn.Close()
+}
+
+func TestServerStoresBatchesFromParallelClientsWithoutInterleaving(t *testing.T) {
+	server, store := startTestServer(t, testConfig(t, 10, 8))
+
+	// A connected agency that never sends anything must not block the rest
+	silent, err := net.Dial("tcp", server.Addr().String())
+	assert.Nil(t, err)
+	defer silent.Close()
+
+	const agencies, batches, batchSize = 8, 10, 20
+	wg := sync.WaitGroup{}
+	for agency := 1; agency <= agencies; agency++ {
+		wg.Add(1)
+		go func(agency int) {
+			defer wg.Done()
+			session, err := openTestSession(server.Addr().String(), agency)
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer session.close()
+
+			for batch := 0; batch < batches; batch++ {
+				reply, err := session.submitBatch(testBatch(agency, batch, batchSize))
+				assert.Nil(t, err)
+				assert.Equal(t, protocol.MessageAck, reply.Type)
+			}
+		}(agency)
+	}
+	wg.Wait()
+
+	bets, err := LoadBets(store)
+	assert.Nil(t, err)
+	assert.Len(t, bets, agencies*batches*batchSize)
+
+	// Every batch must be stored as a contiguous block keeping its order
+	for i := 0; i < len(bets); i += batchSize {
+		for j := 1; j < batchSize; j++ {
+			assert.Equal(t, bets[i].agency, bets[i+j].agency)
+			assert.Equal(t, bets[i].number+j, bets[i+j].number)
+		}
+	}
+}
+
+func TestServerStoresValidBetsAndReportsRejectedOnes(t *testing.T) {
+	server, store := startTestServer(t, testConfig(t, 1, 2))
+
+	session, err := openTestSession(server.Addr().String(), 1)
+	assert.Nil(t, err)
+	defer session.close()
+
+	bets := testBatch(1, 0, 4)
+	bets[1].Birthdate = "not a date"
+	bets[3].Agency = "2"
+
+	reply, err := session.submitBatch(bets)
+	assert.Nil(t, err)
+	rejections, err := protocol.DecodeBetsRejected(reply)
+	assert.Nil(t, err)
+	assert.Equal(t, []protocol.Rejection{
+		{Index: 1, Reason: protocol.RejectInvalidBirthdate},
+		{Index: 3, Reason: protocol.RejectAgencyMismatch},
+	}, rejections)
+
+	stored, err := LoadBets(store)
+	assert.Nil(t, err)
+	if assert.Len(t, stored, 2) {
+		assert.Equal(t, bets[0].Document, stored[0].document)
+		assert.Equal(t, bets[2].Document, stored[1].document)
+	}
+
+	reply, err = session.submitBatch(testBatch(1, 1, 2))
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.MessageAck, reply.Type)
+}
+
+func TestServerRejectsSessionsNotStartingWithHello(t *testing.T) {
+	server, _ := startTestServer(t, testConfig(t, 1, 1))
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	msg, _ := protocol.NewBetBatchMessage(1, testBatch(1, 0, 1))
+	assert.Nil(t, shared.SendMessage(conn, msg, time.Second))
+	reply, err := shared.ReceiveMessage(conn, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.MessageError, reply.Type)
+
+	_, err = openTestSession(server.Addr().String(), 2)
+	assert.ErrorContains(t, err, ErrUnknownAgency.Error())
+}
+
+func TestServerRejectsAgenciesFailingTheChallenge(t *testing.T) {
+	server, _ := startTestServer(t, testConfig(t, 2, 2))
+	addr := server.Addr().String()
+
+	_, err := openTestSessionWithSecret(addr, 1, testSecret(2))
+	assert.ErrorContains(t, err, ErrAuthFailed.Error())
+
+	// Failed attempts must not mark the agency as connected
+	assert.Equal(t, AgencyPending, server.registry.Snapshot()[0].State)
+
+	session, err := openTestSession(addr, 1)
+	assert.Nil(t, err)
+	session.close()
+}
+
+func TestSessionCannotActOnBehalfOfAnotherAgency(t *testing.T) {
+	server, store := startTestServer(t, testConfig(t, 2, 2))
+
+	session, err := openTestSession(server.Addr().String(), 1)
+	assert.Nil(t, err)
+	defer session.close()
+
+	reply, err := session.submitBatch(testBatch(2, 0, 2))
+	assert.Nil(t, err)
+	rejections, err := protocol.DecodeBetsRejected(reply)
+	assert.Nil(t, err)
+	assert.Len(t, rejections, 2)
+
+	finished, _ := protocol.NewBetsFinishedMessage("2")
+	reply, err = session.request(finished)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.MessageError, reply.Type)
+
+	query, _ := protocol.NewWinnersQueryMessage("2")
+	reply, err = session.request(query)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.MessageError, reply.Type)
+
+	stored, err := LoadBets(store)
+	assert.Nil(t, err)
+	assert.Empty(t, stored)
+	assert.Equal(t, AgencyPending, server.registry.Snapshot()[1].State)
+}
+
+func TestStalledClientsAreDroppedWithoutBlockingOthers(t *testing.T) {
+	header, err := protocol.NewAckMessage().Encode()
+	assert.Nil(t, err)
+
+	stalls := map[string]func(t *testing.T, addr string) net.Conn{
+		"silent before hello": func(t *testing.T, addr string) net.Conn {
+			conn, err := net.Dial("tcp", addr)
+			assert.Nil(t, err)
+			return conn
+		},
+		"stalled mid message": func(t *testing.T, addr string) net.Conn {
+			session, err := openTestSession(addr, 1)
+			assert.Nil(t, err)
+			assert.Nil(t, shared.WriteAll(session.conn, header[:2]))
+			return session.conn
+		},
+		"idle session": func(t *testing.T, addr string) net.Conn {
+			session, err := openTestSession(addr, 1)
+			assert.Nil(t, err)
+			return session.conn
+		},
+	}
+
+	for name, stall := range stalls {
+		t.Run(name, func(t *testing.T) {
+			config := testConfig(t, 1, 2)
+			config.ServerReadTimeout = 100 * time.Millisecond
+			config.ServerIdleTimeout = 200 * time.Millisecond
+			server, _ := startTestServer(t, config)
+			addr := server.Addr().String()
+
+			stalled := stall(t, addr)
+			defer stalled.Close()
+
+			// The stalled client holds the only slot until the server
+			// drops it, then the other agency must be served
+			start := time.Now()
+			session, err := openTestSession(addr, 2)
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer session.close()
+			assert.Less(t, time.Since(start), 2*time.Second)
+
+			reply, err := session.submitBatch(testBatch(2, 0, 5))
+			assert.Nil(t, err)
+			assert.Equal(t, protocol.MessageAck, reply.Type)
+
+			_, err = shared.ReceiveMessage(stalled, time.Second)
+			assert.NotNil(t, err, "stalled connection must be closed by the server")
+			assert.False(t, shared.IsTimeout(err))
+		})
+	}
+}
+
+func TestResentBatchesAreStoredOnce(t *testing.T) {
+	server, store := startTestServer(t, testConfig(t, 1, 1))
+
+	session, err := openTestSession(server.Addr().String(), 1)
+	assert.Nil(t, err)
+	defer session.close()
+
+	bets := testBatch(1, 0, 3)
+	bets[2].Number = "-1"
+	first, _ := protocol.NewBetBatchMessage(1, bets)
+	second, _ := protocol.NewBetBatchMessage(2, testBatch(1, 1, 2))
+
+	// The client resends every batch as if the acks were lost
+	for _, msg := range []protocol.Message{first, first, second, first, second} {
+		reply, err := session.request(msg)
+		assert.Nil(t, err)
+		assert.NotEqual(t, protocol.MessageError, reply.Type)
+	}
+
+	// A retry gets the same rejections as the original batch
+	reply, err := session.request(first)
+	assert.Nil(t, err)
+	rejections, err := protocol.DecodeBetsRejected(reply)
+	assert.Nil(t, err)
+	assert.Equal(t, []protocol.Rejection{{Index: 2, Reason: protocol.RejectInvalidNumber}}, rejections)
+
+	stored, err := LoadBets(store)
+	assert.Nil(t, err)
+	assert.Len(t, stored, 4)
+	assert.Equal(t, 4, server.registry.Snapshot()[0].Bets)
+}
+
+func TestSigtermWhileClientsSubmitLeavesNoPartialRows(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	store := openTestStore(t, fs, StorageCSV)
+	server, err := NewServer(testConfig(t, 4, 4), store)
+	assert.Nil(t, err)
+
+	stopSignals := shared.NotifyShutdown(func(os.Signal) { server.Shutdown() })
+	defer stopSignals()
+
+	finished := make(chan struct{})
+	go func() {
+		server.Run()
+		close(finished)
+	}()
+
+	const agencies, batchSize = 4, 50
+	acked := make([]int, agencies+1)
+	wg := sync.WaitGroup{}
+	for agency := 1; agency <= agencies; agency++ {
+		wg.Add(1)
+		go func(agency int) {
+			defer wg.Done()
+			session, err := openTestSession(server.Addr().String(), agency)
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer session.close()
+
+			for batch := 0; ; batch++ {
+				reply, err := session.submitBatch(testBatch(agency, batch, batchSize))
+				if err != nil || reply.Type != protocol.MessageAck {
+					return
+				}
+				acked[agency]++
+			}
+		}(agency)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+	wg.Wait()
+	assert.Nil(t, store.Close())
+
+	reopened := openTestStore(t, fs, StorageCSV)
+	defer reopened.Close()
+	bets, err := LoadBets(reopened)
+	assert.Nil(t, err, "store must not hold partial rows")
+	assert.Equal(t, 0, len(bets)%batchSize, "batches must be stored whole")
+
+	stored := make([]int, agencies+1)
+	for _, bet := range bets {
+		stored[bet.agency]++
+	}
+	for agency := 1; agency <= agencies; agency++ {
+		assert.GreaterOrEqual(t, stored[agency], acked[agency]*batchSize, "acked bets must be stored")
+	}
+}
+
+func TestWinnersAreOnlyReturnedOnceEveryAgencyFinished(t *testing.T) {
+	config := testConfig(t, 2, 2)
+	// Each agency bets on every last digit, so exactly one of its bets wins
+	config.PrizeTiers = "last1:1"
+	server, _ := startTestServer(t, config)
+	addr := server.Addr().String()
+
+	sessions := make(map[int]*testSession)
+	for agency := 1; agency <= 2; agency++ {
+		session, err := openTestSession(addr, agency)
+		assert.Nil(t, err)
+		defer session.close()
+		sessions[agency] = session
+
+		reply, err := session.submitBatch(testBatch(agency, agency, 10))
+		assert.Nil(t, err)
+		assert.Equal(t, protocol.MessageAck, reply.Type)
+	}
+
+	finished, _ := protocol.NewBetsFinishedMessage("1")
+	reply, err := sessions[1].request(finished)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.MessageAck, reply.Type)
+
+	query, _ := protocol.NewWinnersQueryMessage("1")
+	reply, err = sessions[1].request(query)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.MessageDrawPending, reply.Type)
+
+	finished, _ = protocol.NewBetsFinishedMessage("2")
+	reply, err = sessions[2].request(finished)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.MessageAck, reply.Type)
+
+	reply, err = sessions[1].request(query)
+	assert.Nil(t, err)
+	winners, err := protocol.DecodeWinners(reply)
+	assert.Nil(t, err)
+
+	// The winner is the bet of agency 1 on the last digit of the recorded
+	// number, the one of agency 2 is left out
+	draw, err := ReadDraw(afero.NewOsFs(), config.DrawRecordPath)
+	assert.Nil(t, err)
+	assert.Equal(t, 20, draw.Bets)
+	winner := testBatch(1, 1, 10)[draw.Number%10]
+	assert.Equal(t, []protocol.Winner{{Document: winner.Document, Tier: "last1"}}, winners)
+}
+
+func TestRestartedServerKeepsTheRecordedDraw(t *testing.T) {
+	config := testConfig(t, 1, 1)
+	config.PrizeTiers = "last1:1"
+	server, store := startTestServer(t, config)
+
+	session, err := openTestSession(server.Addr().String(), 1)
+	assert.Nil(t, err)
+	reply, err := session.submitBatch(testBatch(1, 1, 10))
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.MessageAck, reply.Type)
+	finished, _ := protocol.NewBetsFinishedMessage("1")
+	reply, err = session.request(finished)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.MessageAck, reply.Type)
+	session.close()
+	server.Shutdown()
+
+	recorded, err := os.ReadFile(config.DrawRecordPath)
+	assert.Nil(t, err)
+
+	restarted, err := NewServer(config, store)
+	assert.Nil(t, err)
+	go restarted.Run()
+	defer restarted.Shutdown()
+
+	session, err = openTestSession(restarted.Addr().String(), 1)
+	assert.Nil(t, err)
+	defer session.close()
+
+	// Intake stays closed, so finishing again does not draw again
+	session.seq = 1
+	reply, err = session.submitBatch(testBatch(1, 2, 10))
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.MessageError, reply.Type)
+	reply, err = session.request(finished)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.MessageAck, reply.Type)
+
+	query, _ := protocol.NewWinnersQueryMessage("1")
+	reply, err = session.request(query)
+	assert.Nil(t, err)
+	winners, err := protocol.DecodeWinners(reply)
+	assert.Nil(t, err)
+	assert.Len(t, winners, 1)
+
+	current, err := os.ReadFile(config.DrawRecordPath)
+	assert.Nil(t, err)
+	assert.Equal(t, recorded, current)
+	bets, err := LoadBets(store)
+	assert.Nil(t, err)
+	assert.Len(t, bets, 10)
+}
+
+func TestServerRefusesDrawRecordNotMatchingTheStore(t *testing.T) {
+	config := testConfig(t, 1, 1)
+	store := openTestStore(t, afero.NewMemMapFs(), StorageCSV)
+	defer store.Close()
+	seed, err := loadDrawSeed(afero.NewOsFs(), config.DrawSeedPath)
+	assert.Nil(t, err)
+
+	draw, err := NewDraw(seed, store, PrizeTable{{Name: "exact", Digits: 4}})
+	assert.Nil(t, err)
+	assert.Nil(t, WriteDraw(afero.NewOsFs(), config.DrawRecordPath, draw))
+	_, err = store.StoreBatch(1, 1, testBets(1, 1, 1))
+	assert.Nil(t, err)
+
+	_, err = NewServer(config, store)
+	assert.ErrorContains(t, err, "does not match the store")
+}
@@ -1,16 +1,24 @@
 package common
 
 import (
-	"encoding/csv"
 	"fmt"
-	"os"
+	"io"
 	"strconv"
 	"time"
+
+	"github.com/spf13/afero"
 )
 
+// Kinds of store that can be selected through STORAGE_TYPE
 const (
-	STORAGE_FILEPATH      = "./bets.csv"
-	LOTTERY_WINNER_NUMBER = 7574
+	// StorageCSV Bets kept as rows of a CSV file, see CSVStore
+	StorageCSV = "csv"
+	// StorageLog Batches kept as records of a binary append log, see
+	// LogStore
+	StorageLog = "log"
+	// StorageMemory Bets kept in memory and lost once the server stops,
+	// see MemoryStore
+	StorageMemory = "memory"
 )
 
 type Bet struct {
@@ -49,61 +57,109 @@ func NewBet(agency string, firstName string, lastName string, document string, b
 	}, nil
 }
 
-func (b *Bet) HasWon() bool {
-	return b.number == LOTTERY_WINNER_NUMBER
+// Prize Returns the highest prize the bet won in the draw, see PrizeTable
+func (b *Bet) Prize(draw *Draw) Prize {
+	for rank, tier := range draw.Prizes {
+		if tier.matches(b.number, draw.Number) {
+			return Prize{Tier: tier.Name, Rank: rank}
+		}
+	}
+	return Prize{}
 }
 
-func StoreBets(bets []*Bet) error {
-	file, err := os.Create(STORAGE_FILEPATH)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %v", err)
-	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
-
-	for _, bet := range bets {
-		record := []string{
-			strconv.Itoa(bet.agency),
-			bet.first_name,
-			bet.last_name,
-			bet.document,
-			bet.birthdate.Format("2006-01-02"),
-			strconv.Itoa(bet.number),
-		}
-		if err := writer.Write(record); err != nil {
-			return fmt.Errorf("error writing record to csv: %v", err)
-		}
+// fields Returns the fields of the bet as they are written to a CSV row
+func (b *Bet) fields() []string {
+	return []string{
+		strconv.Itoa(b.agency),
+		b.first_name,
+		b.last_name,
+		b.document,
+		b.birthdate.Format(time.DateOnly),
+		strconv.Itoa(b.number),
 	}
+}
 
-	return nil
+// BetStore Storage of the bets accepted by the server. Implementations are
+// safe for concurrent use and keep bets in the order they were stored,
+// never interleaving the bets of different batches
+type BetStore interface {
+	// StoreBatch Stores the bets of the batch the agency numbered seq,
+	// unless a batch of the agency with that or a later number was already
+	// stored. Sequence number 0 is used for batches that are not numbered,
+	// which are always stored. Returns whether the bets were stored, in
+	// which case they are committed. On error nothing is stored
+	StoreBatch(agency int, seq uint32, bets []*Bet) (bool, error)
+	// EachBet Calls fn with every bet stored so far, in the same order they
+	// were stored. The scan stops at the first error returned by fn, which
+	// is returned
+	EachBet(fn func(bet *Bet) error) error
+	// EachAgencyBet Calls fn with every bet of the agency stored so far,
+	// like EachBet
+	EachAgencyBet(agency int, fn func(bet *Bet) error) error
+	// Close Releases the resources held by the store
+	Close() error
 }
 
-func LoadBets() ([]*Bet, error) {
-	file, err := os.Open(STORAGE_FILEPATH)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %v", err)
+// NewBetStore Opens a store of the given kind. Stores kept in files use
+// path on fs, creating it if it does not exist
+func NewBetStore(fs afero.Fs, kind string, path string) (BetStore, error) {
+	switch kind {
+	case StorageCSV:
+		return NewCSVStore(fs, path)
+	case StorageLog:
+		return NewLogStore(fs, path)
+	case StorageMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", kind)
 	}
-	defer file.Close()
+}
 
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
-	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %v", err)
-	}
+// StoreBets Stores the bets as a batch that is not numbered. Bets are only
+// considered committed once it returns without error
+func StoreBets(store BetStore, bets []*Bet) error {
+	_, err := store.StoreBatch(0, 0, bets)
+	return err
+}
 
+// LoadBets Reads every bet stored so far, in the same order they were
+// stored. It holds every bet in memory, EachBet should be preferred to go
+// over all of them
+func LoadBets(store BetStore) ([]*Bet, error) {
 	var bets []*Bet
-	for _, record := range records {
-		if len(record) != 6 {
-			return nil, fmt.Errorf("invalid record format")
-		}
-		bet, err := NewBet(record[0], record[1], record[2], record[3], record[4], record[5])
-		if err != nil {
-			return nil, fmt.Errorf("failed to create bet: %v", err)
-		}
+	err := store.EachBet(func(bet *Bet) error {
 		bets = append(bets, bet)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-
 	return bets, nil
 }
+
+// batchSequences Highest sequence number stored of every agency
+type batchSequences map[int]uint32
+
+// isDuplicate Reports whether a batch of the agency with that sequence
+// number, or a later one, was already stored. Sequence number 0 is used
+// for batches that are not numbered, which are never duplicates
+func (s batchSequences) isDuplicate(agency int, seq uint32) bool {
+	return seq != 0 && seq <= s[agency]
+}
+
+// stored Records that the batch of the agency numbered seq was stored
+func (s batchSequences) stored(agency int, seq uint32) {
+	if seq > s[agency] {
+		s[agency] = seq
+	}
+}
+
+// truncateFile Cuts the file back to size and moves its offset there, as
+// not every filesystem keeps appending at the end after a truncation
+func truncateFile(file afero.File, size int64) error {
+	if err := file.Truncate(size); err != nil {
+		return err
+	}
+	_, err := file.Seek(size, io.SeekStart)
+	return err
+}
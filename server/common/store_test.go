@@ -1,11 +1,18 @@
 package common
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -21,18 +28,65 @@ func TestNewBetMustKeepFields(t *testing.T) {
 	assert.Equal(t, bet.number, 7500)
 }
 
-func TestHasWonWithWinnerNumberMustBeTrue(t *testing.T) {
-	bet, err := NewBet("1", "first", "last", "10000000", "2000-12-20", strconv.Itoa(LOTTERY_WINNER_NUMBER))
+func TestPrizeWithWinnerNumberMustBeTheHighestTier(t *testing.T) {
+	bet, err := NewBet("1", "first", "last", "10000000", "2000-12-20", "7574")
+	assert.Nil(t, err)
+	prizes, err := ParsePrizeTiers("exact:4,last2:2")
 	assert.Nil(t, err)
 
-	assert.True(t, bet.HasWon())
+	assert.Equal(t, Prize{Tier: "exact", Rank: 0}, bet.Prize(&Draw{Number: 7574, Prizes: prizes}))
 }
 
-func TestHasWonWithLoserNumberMustBeFalse(t *testing.T) {
-	bet, err := NewBet("1", "first", "last", "10000000", "2000-12-20", strconv.Itoa(LOTTERY_WINNER_NUMBER+1))
+func TestPrizeWithLoserNumberMustBeNone(t *testing.T) {
+	bet, err := NewBet("1", "first", "last", "10000000", "2000-12-20", "7565")
+	assert.Nil(t, err)
+	prizes, err := ParsePrizeTiers("exact:4,last2:2")
 	assert.Nil(t, err)
 
-	assert.False(t, bet.HasWon())
+	prize := bet.Prize(&Draw{Number: 7574, Prizes: prizes})
+	assert.False(t, prize.Won())
+	assert.Equal(t, Prize{}, prize)
+}
+
+// testStorePath Path of the stores opened by the tests on their in memory
+// filesystem
+const testStorePath = "/data/bets"
+
+// openTestStore Opens a store of the kind at testStorePath on fs
+func openTestStore(t *testing.T, fs afero.Fs, kind string) BetStore {
+	store, err := NewBetStore(fs, kind, testStorePath)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return store
+}
+
+// eachStoreKind Runs test against a new store of every kind, each on its
+// own in memory filesystem
+func eachStoreKind(t *testing.T, test func(t *testing.T, store BetStore)) {
+	for _, kind := range []string{StorageCSV, StorageLog, StorageMemory} {
+		t.Run(kind, func(t *testing.T) {
+			store := openTestStore(t, afero.NewMemMapFs(), kind)
+			defer store.Close()
+			test(t, store)
+		})
+	}
+}
+
+// eachFileStoreKind Runs test for every kind of store kept in a file, with
+// an in memory filesystem where stores of that kind can be opened and
+// reopened
+func eachFileStoreKind(t *testing.T, test func(t *testing.T, fs afero.Fs, kind string)) {
+	for _, kind := range []string{StorageCSV, StorageLog} {
+		t.Run(kind, func(t *testing.T) {
+			test(t, afero.NewMemMapFs(), kind)
+		})
+	}
+}
+
+func TestNewBetStoreRejectsUnknownType(t *testing.T) {
+	_, err := NewBetStore(afero.NewMemMapFs(), "sqlite", testStorePath)
+	assert.ErrorContains(t, err, "unknown storage type")
 }
 
 func TestStoreBetsAndLoadBetsKeepsFieldsData(t *testing.T) {
@@ -47,11 +101,13 @@ func TestStoreBetsAndLoadBetsKeepsFieldsData(t *testing.T) {
 		},
 	}
 
-	StoreBets(toStore)
-	storedBets, err := LoadBets()
-	assert.Nil(t, err)
+	eachStoreKind(t, func(t *testing.T, store BetStore) {
+		assert.Nil(t, StoreBets(store, toStore))
+		storedBets, err := LoadBets(store)
+		assert.Nil(t, err)
 
-	assert.Equal(t, toStore, storedBets)
+		assert.Equal(t, toStore, storedBets)
+	})
 }
 
 // test_store_bets_and_load_bets_keeps_registry_order
@@ -75,17 +131,349 @@ func TestStoreBetsAndLoadBetsKeepsRegistryOrder(t *testing.T) {
 		},
 	}
 
-	StoreBets(toStore)
-	storedBets, err := LoadBets()
+	eachStoreKind(t, func(t *testing.T, store BetStore) {
+		assert.Nil(t, StoreBets(store, toStore))
+		storedBets, err := LoadBets(store)
+		assert.Nil(t, err)
+
+		assert.Equal(t, toStore[0], storedBets[0])
+		assert.Equal(t, toStore[1], storedBets[1])
+	})
+}
+
+func TestStoreBetsFromManyBatchesAccumulatesInArrivalOrder(t *testing.T) {
+	eachStoreKind(t, func(t *testing.T, store BetStore) {
+		var stored []*Bet
+		for batch := 0; batch < 20; batch++ {
+			bets := make([]*Bet, 0)
+			for i := 0; i < 5; i++ {
+				bets = append(bets, &Bet{
+					agency:     batch%5 + 1,
+					first_name: fmt.Sprintf("first_%d_%d", batch, i),
+					last_name:  "last, with comma",
+					document:   strconv.Itoa(10000000 + batch*5 + i),
+					birthdate:  time.Date(2000, 12, 20, 0, 0, 0, 0, time.UTC),
+					number:     batch*5 + i,
+				})
+			}
+			assert.Nil(t, StoreBets(store, bets))
+			stored = append(stored, bets...)
+		}
+
+		storedBets, err := LoadBets(store)
+		assert.Nil(t, err)
+		assert.Equal(t, stored, storedBets)
+	})
+}
+
+func TestStoreReopenedKeepsPreviouslyStoredBets(t *testing.T) {
+	first := []*Bet{
+		{
+			agency:     1,
+			first_name: "first_0",
+			last_name:  "last_0",
+			document:   "10000000",
+			birthdate:  time.Date(2000, 12, 20, 0, 0, 0, 0, time.UTC),
+			number:     7500,
+		},
+	}
+	second := []*Bet{
+		{
+			agency:     2,
+			first_name: "first_1",
+			last_name:  "last_1",
+			document:   "10000001",
+			birthdate:  time.Date(2000, 12, 21, 0, 0, 0, 0, time.UTC),
+			number:     7501,
+		},
+	}
+
+	eachFileStoreKind(t, func(t *testing.T, fs afero.Fs, kind string) {
+		store := openTestStore(t, fs, kind)
+		assert.Nil(t, StoreBets(store, first))
+		assert.Nil(t, store.Close())
+
+		store = openTestStore(t, fs, kind)
+		defer store.Close()
+		assert.Nil(t, StoreBets(store, second))
+
+		storedBets, err := LoadBets(store)
+		assert.Nil(t, err)
+		assert.Equal(t, append(first, second...), storedBets)
+	})
+}
+
+func testBets(agency int, batch int, size int) []*Bet {
+	bets := make([]*Bet, 0, size)
+	for i := 0; i < size; i++ {
+		bets = append(bets, &Bet{
+			agency:     agency,
+			first_name: fmt.Sprintf("first_%d_%d", batch, i),
+			last_name:  "last",
+			document:   strconv.Itoa(10000000 + batch*size + i),
+			birthdate:  time.Date(2000, 12, 20, 0, 0, 0, 0, time.UTC),
+			number:     i,
+		})
+	}
+	return bets
+}
+
+func TestStoreBatchSkipsSequencesAlreadyStored(t *testing.T) {
+	eachStoreKind(t, func(t *testing.T, store BetStore) {
+		stored, err := store.StoreBatch(1, 1, testBets(1, 1, 3))
+		assert.Nil(t, err)
+		assert.True(t, stored)
+		stored, err = store.StoreBatch(2, 1, testBets(2, 1, 3))
+		assert.Nil(t, err)
+		assert.True(t, stored, "sequences are scoped to the agency")
+		stored, err = store.StoreBatch(1, 1, testBets(1, 1, 3))
+		assert.Nil(t, err)
+		assert.False(t, stored)
+		stored, err = store.StoreBatch(1, 0, testBets(1, 2, 3))
+		assert.Nil(t, err)
+		assert.True(t, stored, "batches that are not numbered are always stored")
+
+		bets, err := LoadBets(store)
+		assert.Nil(t, err)
+		assert.Len(t, bets, 9)
+	})
+}
+
+func TestStoreBatchSkipsSequencesAlreadyStoredAcrossRestarts(t *testing.T) {
+	eachFileStoreKind(t, func(t *testing.T, fs afero.Fs, kind string) {
+		store := openTestStore(t, fs, kind)
+		_, err := store.StoreBatch(1, 1, testBets(1, 1, 3))
+		assert.Nil(t, err)
+		_, err = store.StoreBatch(2, 1, testBets(2, 1, 3))
+		assert.Nil(t, err)
+		assert.Nil(t, store.Close())
+
+		store = openTestStore(t, fs, kind)
+		defer store.Close()
+		stored, err := store.StoreBatch(1, 1, testBets(1, 1, 3))
+		assert.Nil(t, err)
+		assert.False(t, stored)
+		stored, err = store.StoreBatch(1, 2, testBets(1, 2, 3))
+		assert.Nil(t, err)
+		assert.True(t, stored)
+
+		bets, err := LoadBets(store)
+		assert.Nil(t, err)
+		assert.Len(t, bets, 9)
+	})
+}
+
+func TestCSVStoreDiscardsBetsOfUncommittedBatchOnReopen(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	store := openTestStore(t, fs, StorageCSV)
+	_, err := store.StoreBatch(1, 1, testBets(1, 1, 3))
+	assert.Nil(t, err)
+	assert.Nil(t, store.Close())
+	committed, err := afero.ReadFile(fs, testStorePath)
 	assert.Nil(t, err)
 
-	assert.Equal(t, toStore[0], storedBets[0])
-	assert.Equal(t, toStore[1], storedBets[1])
+	// A crash after writing bets of a batch but before its log record was
+	// synced leaves rows, maybe torn, past the committed size and a
+	// partial record
+	file, err := fs.OpenFile(testStorePath, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteString("1,first_2_0,last,10000006,2000-12-20,0\n1,first_2_1,la")
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	wal, err := fs.OpenFile(walPath(testStorePath), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = wal.Write([]byte{0, 0, 0, 90, 1, 2})
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Close())
+
+	store = openTestStore(t, fs, StorageCSV)
+	defer store.Close()
+	content, err := afero.ReadFile(fs, testStorePath)
+	assert.Nil(t, err)
+	assert.Equal(t, committed, content)
+
+	// The batch was never acknowledged, so the client sends it again
+	stored, err := store.StoreBatch(1, 2, testBets(1, 2, 3))
+	assert.Nil(t, err)
+	assert.True(t, stored)
+	bets, err := LoadBets(store)
+	assert.Nil(t, err)
+	assert.Equal(t, append(testBets(1, 1, 3), testBets(1, 2, 3)...), bets)
+}
+
+// chainedRows Returns a bets file holding the rows, each followed by its
+// digest
+func chainedRows(rows ...string) []byte {
+	var chain chainHash
+	var content []byte
+	for _, row := range rows {
+		chain = chainRow(chain, strings.Split(row, ","))
+		content = append(content, row+","+chain.String()+"\n"...)
+	}
+	return content
 }
 
-func TestMain(m *testing.M) {
-	_ = os.Remove(STORAGE_FILEPATH)
-	code := m.Run()
-	_ = os.Remove(STORAGE_FILEPATH)
-	os.Exit(code)
+func TestCSVStoreAdoptsBetsFileWrittenWithoutLog(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.Nil(t, afero.WriteFile(fs, testStorePath, chainedRows("1,first,last,10000000,2000-12-20,7500"), 0644))
+
+	store := openTestStore(t, fs, StorageCSV)
+	defer store.Close()
+
+	bets, err := LoadBets(store)
+	assert.Nil(t, err)
+	assert.Len(t, bets, 1)
+
+	// Rows stored next are chained to the adopted ones
+	assert.Nil(t, StoreBets(store, testBets(1, 1, 2)))
+	verified, err := VerifyStore(fs, StorageCSV, testStorePath)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, verified)
+}
+
+func TestEachAgencyBetOnlyVisitsBetsOfTheAgency(t *testing.T) {
+	eachStoreKind(t, func(t *testing.T, store BetStore) {
+		_, err := store.StoreBatch(1, 1, testBets(1, 1, 3))
+		assert.Nil(t, err)
+		_, err = store.StoreBatch(2, 1, testBets(2, 2, 2))
+		assert.Nil(t, err)
+		_, err = store.StoreBatch(1, 2, testBets(1, 3, 3))
+		assert.Nil(t, err)
+
+		var bets []*Bet
+		err = store.EachAgencyBet(1, func(bet *Bet) error {
+			bets = append(bets, bet)
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, append(testBets(1, 1, 3), testBets(1, 3, 3)...), bets)
+
+		err = store.EachAgencyBet(3, func(bet *Bet) error {
+			t.Errorf("unexpected bet of agency %d", bet.agency)
+			return nil
+		})
+		assert.Nil(t, err)
+	})
+}
+
+func TestEachBetStopsAtCallbackError(t *testing.T) {
+	eachStoreKind(t, func(t *testing.T, store BetStore) {
+		assert.Nil(t, StoreBets(store, testBets(1, 1, 10)))
+
+		stop := errors.New("stop")
+		visited := 0
+		err := store.EachBet(func(bet *Bet) error {
+			visited++
+			if visited == 4 {
+				return stop
+			}
+			return nil
+		})
+		assert.ErrorIs(t, err, stop)
+		assert.Equal(t, 4, visited)
+	})
+}
+
+func TestCSVStoreRefusesToAdoptInvalidRow(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	rows := chainedRows("1,first,last,10000000,2000-12-20,7500", "1,first,last,10000001,20-12-2000,7501")
+	assert.Nil(t, afero.WriteFile(fs, testStorePath, rows, 0644))
+
+	_, err := NewCSVStore(fs, testStorePath)
+	var integrityErr *IntegrityError
+	assert.ErrorAs(t, err, &integrityErr)
+	assert.Equal(t, 2, integrityErr.Line)
+}
+
+// writeBenchmarkBets Writes a bets file holding amount bets of 5 agencies
+func writeBenchmarkBets(b *testing.B, path string, amount int) {
+	file, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	var chain chainHash
+	for i := 0; i < amount; i++ {
+		row := fmt.Sprintf("%d,first_%d,last_%d,%d,2000-12-20,%d", i%5+1, i, i, 10000000+i, i%10000)
+		chain = chainRow(chain, strings.Split(row, ","))
+		fmt.Fprintf(writer, "%s,%s\n", row, chain)
+	}
+	if err := writer.Flush(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkEachBet Scans generated files of increasing size. The peak heap
+// reported stays the same whatever the amount of bets, while LoadBets
+// grows with it. Files are kept on disk, so they are not part of the heap
+func BenchmarkEachBet(b *testing.B) {
+	dir := b.TempDir()
+	for _, amount := range []int{100_000, 1_000_000, 3_000_000} {
+		path := filepath.Join(dir, fmt.Sprintf("bets-%d.csv", amount))
+		writeBenchmarkBets(b, path, amount)
+		store, err := NewCSVStore(afero.NewOsFs(), path)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("EachBet/%d", amount), func(b *testing.B) {
+			benchmarkHeap(b, func(sample func()) error {
+				return store.EachBet(func(bet *Bet) error {
+					sample()
+					return nil
+				})
+			})
+		})
+		b.Run(fmt.Sprintf("EachAgencyBet/%d", amount), func(b *testing.B) {
+			benchmarkHeap(b, func(sample func()) error {
+				return store.EachAgencyBet(1, func(bet *Bet) error {
+					sample()
+					return nil
+				})
+			})
+		})
+		if amount <= 1_000_000 {
+			b.Run(fmt.Sprintf("LoadBets/%d", amount), func(b *testing.B) {
+				benchmarkHeap(b, func(sample func()) error {
+					bets, err := LoadBets(store)
+					sample()
+					runtime.KeepAlive(bets)
+					return err
+				})
+			})
+		}
+		store.Close()
+	}
+}
+
+// benchmarkHeap Runs scan b.N times reporting the peak heap in use above
+// the one before starting, sampled by scan through the function it gets
+func benchmarkHeap(b *testing.B, scan func(sample func()) error) {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	base := stats.HeapAlloc
+	peak := uint64(0)
+	calls := 0
+	sample := func() {
+		calls++
+		if calls%(1<<16) != 1 {
+			return
+		}
+		runtime.ReadMemStats(&stats)
+		if stats.HeapAlloc > base && stats.HeapAlloc-base > peak {
+			peak = stats.HeapAlloc - base
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := scan(sample); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
 }
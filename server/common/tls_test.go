@@ -0,0 +1,88 @@
+package common
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared/certs"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared/protocol"
+)
+
+// writeTestCerts Creates a CA, a certificate for the loopback server and
+// one per agency in a temporary directory, returning the directory
+func writeTestCerts(t *testing.T, agencies int) string {
+	dir := t.TempDir()
+	write := func(name string, cert []byte, key []byte) {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name+".pem"), cert, 0644))
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name+"-key.pem"), key, 0600))
+	}
+
+	ca, err := certs.NewAuthority("test CA", time.Hour)
+	assert.Nil(t, err)
+	caKey, err := ca.KeyPEM()
+	assert.Nil(t, err)
+	write("ca", ca.CertPEM(), caKey)
+
+	cert, key, err := ca.IssueServer("server", []string{"127.0.0.1"}, time.Hour)
+	assert.Nil(t, err)
+	write("server", cert, key)
+
+	for agency := 1; agency <= agencies; agency++ {
+		cert, key, err := ca.IssueClient(strconv.Itoa(agency), time.Hour)
+		assert.Nil(t, err)
+		write("agency-"+strconv.Itoa(agency), cert, key)
+	}
+	return dir
+}
+
+func TestServerOverMutualTLS(t *testing.T) {
+	dir := writeTestCerts(t, 2)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	config := testConfig(t, 4, 2)
+	config.ServerTlsEnabled = true
+	config.ServerTlsCert = path("server.pem")
+	config.ServerTlsKey = path("server-key.pem")
+	config.ServerTlsCa = path("ca.pem")
+	config.ServerTlsRequireClientCert = true
+	server, store := startTestServer(t, config)
+	addr := server.Addr().String()
+
+	dial := func(agency int) (*tls.Conn, error) {
+		name := "agency-" + strconv.Itoa(agency)
+		tlsConfig, err := shared.ClientTLSConfig(path(name+".pem"), path(name+"-key.pem"), path("ca.pem"), "127.0.0.1")
+		assert.Nil(t, err)
+		return tls.Dial("tcp", addr, tlsConfig)
+	}
+
+	conn, err := dial(1)
+	assert.Nil(t, err)
+	session, err := startTestSession(conn, 1, testSecret(1))
+	assert.Nil(t, err)
+	reply, err := session.submitBatch(testBatch(1, 0, 3))
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.MessageAck, reply.Type)
+	session.close()
+
+	stored, err := LoadBets(store)
+	assert.Nil(t, err)
+	assert.Len(t, stored, 3)
+
+	// The certificate of an agency cannot be used to open a session of
+	// another one, even knowing its secret
+	conn, err = dial(2)
+	assert.Nil(t, err)
+	_, err = startTestSession(conn, 1, testSecret(1))
+	assert.ErrorContains(t, err, ErrAgencyMismatch.Error())
+
+	// Plaintext peers never get to open a session
+	_, err = openTestSession(addr, 1)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,108 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared/protocol"
+)
+
+const (
+	// maxNameLength Maximum amount of characters of a first or last name
+	maxNameLength = 64
+	// minDocumentLength and maxDocumentLength Bounds for the amount of
+	// digits of a document
+	minDocumentLength = 7
+	maxDocumentLength = 8
+	// minAge Age a bettor must have reached to place a bet
+	minAge = 18
+	// maxBetNumber Highest number a bet can be placed on, the lowest is 0
+	maxBetNumber = 9999
+)
+
+// RejectedBetError Returned when a bet does not pass validation, holding
+// the reason reported back to the agency
+type RejectedBetError struct {
+	Reason protocol.RejectReason
+	Detail string
+}
+
+func (e *RejectedBetError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Detail)
+}
+
+func rejectBet(reason protocol.RejectReason, format string, args ...interface{}) error {
+	return &RejectedBetError{Reason: reason, Detail: fmt.Sprintf(format, args...)}
+}
+
+// ValidateBet Parses and validates a bet received on the session of the
+// given agency. now is the moment the bet is received, used to check the
+// age of the bettor. A *RejectedBetError is returned for invalid bets
+func ValidateBet(data protocol.Bet, agency int, now time.Time) (*Bet, error) {
+	betAgency, err := strconv.Atoi(data.Agency)
+	if err != nil {
+		return nil, rejectBet(protocol.RejectInvalidAgency, "%q is not a number", data.Agency)
+	}
+	if betAgency != agency {
+		return nil, rejectBet(protocol.RejectAgencyMismatch, "bet of agency %d sent by agency %d", betAgency, agency)
+	}
+
+	if err := validateName(data.FirstName); err != nil {
+		return nil, err
+	}
+	if err := validateName(data.LastName); err != nil {
+		return nil, err
+	}
+
+	if err := validateDocument(data.Document); err != nil {
+		return nil, err
+	}
+
+	birthdate, err := time.Parse(time.DateOnly, data.Birthdate)
+	if err != nil {
+		return nil, rejectBet(protocol.RejectInvalidBirthdate, "%q is not a date", data.Birthdate)
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if birthdate.After(today) {
+		return nil, rejectBet(protocol.RejectFutureBirthdate, "%s is in the future", data.Birthdate)
+	}
+	if birthdate.AddDate(minAge, 0, 0).After(today) {
+		return nil, rejectBet(protocol.RejectUnderage, "born on %s", data.Birthdate)
+	}
+
+	number, err := strconv.Atoi(data.Number)
+	if err != nil || number < 0 || number > maxBetNumber {
+		return nil, rejectBet(protocol.RejectInvalidNumber, "%q is not between 0 and %d", data.Number, maxBetNumber)
+	}
+
+	return &Bet{
+		agency:     betAgency,
+		first_name: data.FirstName,
+		last_name:  data.LastName,
+		document:   data.Document,
+		birthdate:  birthdate,
+		number:     number,
+	}, nil
+}
+
+func validateName(name string) error {
+	length := utf8.RuneCountInString(name)
+	if length == 0 || length > maxNameLength {
+		return rejectBet(protocol.RejectInvalidName, "names must have between 1 and %d characters", maxNameLength)
+	}
+	return nil
+}
+
+func validateDocument(document string) error {
+	if len(document) < minDocumentLength || len(document) > maxDocumentLength {
+		return rejectBet(protocol.RejectInvalidDocument, "%q must have between %d and %d digits", document, minDocumentLength, maxDocumentLength)
+	}
+	for _, c := range document {
+		if c < '0' || c > '9' {
+			return rejectBet(protocol.RejectInvalidDocument, "%q is not numeric", document)
+		}
+	}
+	return nil
+}
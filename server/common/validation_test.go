@@ -0,0 +1,76 @@
+package common
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared/protocol"
+)
+
+func validTestBet() protocol.Bet {
+	return protocol.Bet{
+		Agency:    "1",
+		FirstName: "Santiago Lionel",
+		LastName:  "Lorca",
+		Document:  "30904465",
+		Birthdate: "1999-03-17",
+		Number:    "7574",
+	}
+}
+
+func TestValidateBetAcceptsValidBet(t *testing.T) {
+	now := time.Date(2024, 3, 17, 12, 0, 0, 0, time.UTC)
+
+	bet, err := ValidateBet(validTestBet(), 1, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, bet.agency)
+	assert.Equal(t, 7574, bet.number)
+	assert.Equal(t, "30904465", bet.document)
+
+	// Turning 18 on the day the bet is received is enough
+	data := validTestBet()
+	data.Birthdate = "2006-03-17"
+	_, err = ValidateBet(data, 1, now)
+	assert.Nil(t, err)
+}
+
+func TestValidateBetRejectsWithReason(t *testing.T) {
+	now := time.Date(2024, 3, 17, 12, 0, 0, 0, time.UTC)
+
+	cases := map[string]struct {
+		modify func(bet *protocol.Bet)
+		reason protocol.RejectReason
+	}{
+		"non numeric agency":   {func(b *protocol.Bet) { b.Agency = "one" }, protocol.RejectInvalidAgency},
+		"other agency":         {func(b *protocol.Bet) { b.Agency = "2" }, protocol.RejectAgencyMismatch},
+		"empty first name":     {func(b *protocol.Bet) { b.FirstName = "" }, protocol.RejectInvalidName},
+		"overlong last name":   {func(b *protocol.Bet) { b.LastName = string(make([]byte, maxNameLength+1)) }, protocol.RejectInvalidName},
+		"non numeric document": {func(b *protocol.Bet) { b.Document = "3090446A" }, protocol.RejectInvalidDocument},
+		"short document":       {func(b *protocol.Bet) { b.Document = "123456" }, protocol.RejectInvalidDocument},
+		"long document":        {func(b *protocol.Bet) { b.Document = "123456789" }, protocol.RejectInvalidDocument},
+		"malformed birthdate":  {func(b *protocol.Bet) { b.Birthdate = "17/03/1999" }, protocol.RejectInvalidBirthdate},
+		"future birthdate":     {func(b *protocol.Bet) { b.Birthdate = "2024-03-18" }, protocol.RejectFutureBirthdate},
+		"underage bettor":      {func(b *protocol.Bet) { b.Birthdate = "2006-03-18" }, protocol.RejectUnderage},
+		"negative number":      {func(b *protocol.Bet) { b.Number = "-1" }, protocol.RejectInvalidNumber},
+		"number over 9999":     {func(b *protocol.Bet) { b.Number = "10000" }, protocol.RejectInvalidNumber},
+		"non numeric number":   {func(b *protocol.Bet) { b.Number = "seven" }, protocol.RejectInvalidNumber},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			data := validTestBet()
+			c.modify(&data)
+
+			bet, err := ValidateBet(data, 1, now)
+			assert.Nil(t, bet)
+
+			var rejected *RejectedBetError
+			if assert.True(t, errors.As(err, &rejected)) {
+				assert.Equal(t, c.reason, rejected.Reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+const (
+	walLengthSize = 4
+	walCRCSize    = 4
+	// walHeaderSize Length and checksum preceding the body of a record
+	walHeaderSize = walLengthSize + walCRCSize
+)
+
+var (
+	// errTornRecord Returned while reading a log that ends in a record
+	// left half written, or never synced, by a crash
+	errTornRecord = errors.New("torn record")
+	// errCorruptRecord Returned while reading a log holding an invalid
+	// record followed by valid ones, which a crash cannot explain
+	errCorruptRecord = errors.New("corrupt record")
+)
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// appendWalRecord Appends to dst the record holding body: its big endian
+// uint32 length and CRC-32C checksum followed by the body itself
+func appendWalRecord(dst []byte, body []byte) ([]byte, error) {
+	if len(body) == 0 || uint64(len(body)) > math.MaxUint32 {
+		return nil, fmt.Errorf("invalid record size: %d bytes", len(body))
+	}
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(body)))
+	dst = binary.BigEndian.AppendUint32(dst, crc32.Checksum(body, walTable))
+	return append(dst, body...), nil
+}
+
+// walReader Reads the records of the first size bytes of a log written
+// with appendWalRecord
+type walReader struct {
+	file   io.ReaderAt
+	reader *bufio.Reader
+	size   int64
+	// start Offset of the last record read
+	start int64
+	// offset Offset right after the last valid record read
+	offset int64
+}
+
+func newWalReader(file io.ReaderAt, size int64) *walReader {
+	return &walReader{
+		file:   file,
+		reader: bufio.NewReader(io.NewSectionReader(file, 0, size)),
+		size:   size,
+	}
+}
+
+// next Returns the body of the next record, or io.EOF once every record
+// was read. An invalid record ends the log: errTornRecord is returned if
+// it is the last one, as a crash while it was being appended would leave
+// it, and errCorruptRecord otherwise
+func (r *walReader) next() ([]byte, error) {
+	if r.offset == r.size {
+		return nil, io.EOF
+	}
+
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(r.reader, header[:]); err != nil {
+		return nil, r.invalid(err, 0)
+	}
+	length := int64(binary.BigEndian.Uint32(header[:]))
+	if length == 0 || length > r.size-r.offset-walHeaderSize {
+		return nil, r.invalid(errors.New("record length beyond the end of the log"), length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r.reader, body); err != nil {
+		return nil, r.invalid(err, length)
+	}
+	if crc32.Checksum(body, walTable) != binary.BigEndian.Uint32(header[walLengthSize:]) {
+		return nil, r.invalid(errors.New("checksum mismatch"), length)
+	}
+
+	r.start = r.offset
+	r.offset += walHeaderSize + length
+	return body, nil
+}
+
+// invalid Tells a torn record apart from a corrupt one. The invalid record
+// at offset declared length bytes of body, if a valid record follows them
+// the log was damaged after being written
+func (r *walReader) invalid(cause error, length int64) error {
+	if errors.Is(cause, io.EOF) || errors.Is(cause, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w at offset %d: log ends in the middle of the record", errTornRecord, r.offset)
+	}
+	if length > 0 && r.validRecordAt(r.offset+walHeaderSize+length) {
+		return fmt.Errorf("%w at offset %d: %v", errCorruptRecord, r.offset, cause)
+	}
+	return fmt.Errorf("%w at offset %d: %v", errTornRecord, r.offset, cause)
+}
+
+// validRecordAt Reports whether a whole valid record starts at offset
+func (r *walReader) validRecordAt(offset int64) bool {
+	var header [walHeaderSize]byte
+	if offset+walHeaderSize > r.size {
+		return false
+	}
+	if _, err := r.file.ReadAt(header[:], offset); err != nil {
+		return false
+	}
+	length := int64(binary.BigEndian.Uint32(header[:]))
+	if length == 0 || offset+walHeaderSize+length > r.size {
+		return false
+	}
+	body := make([]byte, length)
+	if _, err := r.file.ReadAt(body, offset+walHeaderSize); err != nil {
+		return false
+	}
+	return crc32.Checksum(body, walTable) == binary.BigEndian.Uint32(header[walLengthSize:])
+}
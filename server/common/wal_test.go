@@ -0,0 +1,300 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+var errCrashed = errors.New("crashed")
+
+// crashFs Filesystem that crashes once budget bytes were written through
+// it: the write crossing the budget is cut short and from then on every
+// write, sync, truncate or rename fails, leaving the underlying filesystem
+// as a crash would. A negative budget never crashes
+type crashFs struct {
+	afero.Fs
+	mu      sync.Mutex
+	budget  int64
+	crashed bool
+}
+
+func newCrashFs(fs afero.Fs) *crashFs {
+	return &crashFs{Fs: fs, budget: -1}
+}
+
+// crashAfter Makes the filesystem crash once n more bytes are written
+func (c *crashFs) crashAfter(n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.budget = n
+}
+
+// take Returns how many of n bytes may be written before crashing
+func (c *crashFs) take(n int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.crashed {
+		return 0
+	}
+	if c.budget < 0 || int64(n) <= c.budget {
+		if c.budget >= 0 {
+			c.budget -= int64(n)
+		}
+		return n
+	}
+	taken := int(c.budget)
+	c.budget = 0
+	c.crashed = true
+	return taken
+}
+
+func (c *crashFs) check() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.crashed {
+		return errCrashed
+	}
+	return nil
+}
+
+func (c *crashFs) Create(name string) (afero.File, error) {
+	return c.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+}
+
+func (c *crashFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	file, err := c.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &crashFile{File: file, fs: c}, nil
+}
+
+func (c *crashFs) Rename(oldname, newname string) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	return c.Fs.Rename(oldname, newname)
+}
+
+type crashFile struct {
+	afero.File
+	fs *crashFs
+}
+
+func (f *crashFile) Write(p []byte) (int, error) {
+	n := f.fs.take(len(p))
+	written, err := f.File.Write(p[:n])
+	if err == nil && n < len(p) {
+		err = errCrashed
+	}
+	return written, err
+}
+
+func (f *crashFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *crashFile) Sync() error {
+	if err := f.fs.check(); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func (f *crashFile) Truncate(size int64) error {
+	if err := f.fs.check(); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
+
+func TestFileStoresSurviveCrashAtEveryByteOfABatch(t *testing.T) {
+	committed := testBets(1, 1, 3)
+	batch := testBets(1, 2, 3)
+	all := append(append([]*Bet{}, committed...), batch...)
+
+	cases := map[string]struct {
+		kind string
+		// compact Whether the CSV store compacts its log after the batch
+		compact bool
+	}{
+		"csv":            {kind: StorageCSV},
+		"csv compacting": {kind: StorageCSV, compact: true},
+		"log":            {kind: StorageLog},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			for budget := int64(0); ; budget++ {
+				fs := afero.NewMemMapFs()
+				store := openTestStore(t, fs, c.kind)
+				_, err := store.StoreBatch(1, 1, committed)
+				assert.Nil(t, err)
+				assert.Nil(t, store.Close())
+
+				crash := newCrashFs(fs)
+				store = openTestStore(t, crash, c.kind)
+				if c.compact {
+					store.(*CSVStore).compactSize = 1
+				}
+				crash.crashAfter(budget)
+				stored, err := store.StoreBatch(1, 2, batch)
+				acked := stored && err == nil
+
+				// Recover from what the crash left, without closing the
+				// crashed store
+				store = openTestStore(t, fs, c.kind)
+				bets, err := LoadBets(store)
+				assert.Nil(t, err, "crash after %d bytes", budget)
+				if acked {
+					assert.Equal(t, all, bets, "crash after %d bytes", budget)
+				} else {
+					assert.Equal(t, committed, bets, "crash after %d bytes", budget)
+				}
+
+				// A batch that was not acknowledged is sent again, and is
+				// stored once either way
+				_, err = store.StoreBatch(1, 2, batch)
+				assert.Nil(t, err, "crash after %d bytes", budget)
+				bets, err = LoadBets(store)
+				assert.Nil(t, err)
+				assert.Equal(t, all, bets, "crash after %d bytes", budget)
+				assert.Nil(t, store.Close())
+
+				if crash.check() == nil {
+					// The whole batch was written before the budget ran out
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestCSVStoreReplaysCommittedBatchMissingFromBetsFile(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	store := openTestStore(t, fs, StorageCSV)
+	_, err := store.StoreBatch(1, 1, testBets(1, 1, 3))
+	assert.Nil(t, err)
+	committed, err := afero.ReadFile(fs, testStorePath)
+	assert.Nil(t, err)
+	_, err = store.StoreBatch(1, 2, testBets(1, 2, 3))
+	assert.Nil(t, err)
+
+	// A crash after the log record was synced but before the rows reached
+	// the bets file, or with only part of them written
+	assert.Nil(t, afero.WriteFile(fs, testStorePath, append(committed, "1,fir"...), 0644))
+
+	store = openTestStore(t, fs, StorageCSV)
+	defer store.Close()
+	bets, err := LoadBets(store)
+	assert.Nil(t, err)
+	assert.Equal(t, append(testBets(1, 1, 3), testBets(1, 2, 3)...), bets)
+	stored, err := store.StoreBatch(1, 2, testBets(1, 2, 3))
+	assert.Nil(t, err)
+	assert.False(t, stored)
+}
+
+func TestCSVStoreRewritesGarbledRowsOfLoggedBatches(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	store := openTestStore(t, fs, StorageCSV)
+	_, err := store.StoreBatch(1, 1, testBets(1, 1, 3))
+	assert.Nil(t, err)
+	_, err = store.StoreBatch(1, 2, testBets(1, 2, 3))
+	assert.Nil(t, err)
+
+	// A power loss can leave the unsynced rows with the right length but
+	// other bytes
+	content, err := afero.ReadFile(fs, testStorePath)
+	assert.Nil(t, err)
+	garbled := append([]byte(nil), content...)
+	for i := len(garbled) / 3; i < len(garbled); i++ {
+		garbled[i] = 0
+	}
+	assert.Nil(t, afero.WriteFile(fs, testStorePath, garbled, 0644))
+
+	store = openTestStore(t, fs, StorageCSV)
+	defer store.Close()
+	bets, err := LoadBets(store)
+	assert.Nil(t, err)
+	assert.Equal(t, append(testBets(1, 1, 3), testBets(1, 2, 3)...), bets)
+	recovered, err := afero.ReadFile(fs, testStorePath)
+	assert.Nil(t, err)
+	assert.Equal(t, content, recovered)
+}
+
+func TestCSVStoreRefusesCorruptLog(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	store := openTestStore(t, fs, StorageCSV)
+	_, err := store.StoreBatch(1, 1, testBets(1, 1, 3))
+	assert.Nil(t, err)
+	_, err = store.StoreBatch(1, 2, testBets(1, 2, 3))
+	assert.Nil(t, err)
+
+	// Flip a byte of the first batch record, followed by a valid one
+	wal, err := afero.ReadFile(fs, walPath(testStorePath))
+	assert.Nil(t, err)
+	checkpoint, err := newWalReader(bytes.NewReader(wal), int64(len(wal))).next()
+	assert.Nil(t, err)
+	wal[walHeaderSize+len(checkpoint)+walHeaderSize+1] ^= 0xff
+	assert.Nil(t, afero.WriteFile(fs, walPath(testStorePath), wal, 0644))
+
+	_, err = NewCSVStore(fs, testStorePath)
+	assert.ErrorIs(t, err, errCorruptRecord)
+}
+
+func TestWalReaderTellsTornFromCorruptRecords(t *testing.T) {
+	var wal []byte
+	for _, body := range []string{"first", "second", "third"} {
+		var err error
+		wal, err = appendWalRecord(wal, []byte(body))
+		assert.Nil(t, err)
+	}
+	readAll := func(wal []byte) ([]string, error) {
+		reader := newWalReader(bytes.NewReader(wal), int64(len(wal)))
+		var bodies []string
+		for {
+			body, err := reader.next()
+			if err == io.EOF {
+				return bodies, nil
+			}
+			if err != nil {
+				return bodies, err
+			}
+			bodies = append(bodies, string(body))
+		}
+	}
+
+	bodies, err := readAll(wal)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"first", "second", "third"}, bodies)
+
+	// Any prefix of the last record is torn
+	last := len(wal) - walHeaderSize - len("third")
+	for cut := last + 1; cut < len(wal); cut++ {
+		bodies, err = readAll(wal[:cut])
+		assert.ErrorIs(t, err, errTornRecord, "cut at %d", cut)
+		assert.Equal(t, []string{"first", "second"}, bodies)
+	}
+
+	// So is a damaged last record, a crash may leave it unsynced
+	damaged := append([]byte{}, wal...)
+	damaged[len(damaged)-1] ^= 0xff
+	_, err = readAll(damaged)
+	assert.ErrorIs(t, err, errTornRecord)
+
+	// But not a damaged record followed by valid ones
+	damaged = append([]byte{}, wal...)
+	damaged[walHeaderSize] ^= 0xff
+	bodies, err = readAll(damaged)
+	assert.ErrorIs(t, err, errCorruptRecord)
+	assert.Empty(t, bodies)
+}
@@ -1,31 +1,46 @@
 package main
 
 import (
+	"os"
+
 	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/common"
 	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
 	"github.com/op/go-logging"
 
+	"github.com/spf13/afero"
 	"github.com/spf13/viper"
 )
 
 type IniData struct {
-	Default Config
-}
-
-type Config struct {
-	ServerPort          int    `mapstructure:"SERVER_PORT"`
-	ServerIp            string `mapstructure:"SERVER_IP"`
-	ServerListenBacklog int    `mapstructure:"SERVER_LISTEN_BACKLOG"`
-	LoggingLevel        string `mapstructure:"LOGGING_LEVEL"`
+	Default common.Config
 }
 
 var log = logging.MustGetLogger("log")
 
-func initializeConfig() *Config {
+func initializeConfig() *common.Config {
 	v := viper.New()
 	_ = v.BindEnv("default.server_port", "SERVER_PORT")
 	_ = v.BindEnv("default.server_ip", "SERVER_IP")
 	_ = v.BindEnv("default.server_listen_backlog", "SERVER_LISTEN_BACKLOG")
+	_ = v.BindEnv("default.server_reuse_addr", "SERVER_REUSE_ADDR")
+	_ = v.BindEnv("default.server_reuse_port", "SERVER_REUSE_PORT")
+	_ = v.BindEnv("default.server_max_clients", "SERVER_MAX_CLIENTS")
+	_ = v.BindEnv("default.server_read_timeout", "SERVER_READ_TIMEOUT")
+	_ = v.BindEnv("default.server_write_timeout", "SERVER_WRITE_TIMEOUT")
+	_ = v.BindEnv("default.server_idle_timeout", "SERVER_IDLE_TIMEOUT")
+	_ = v.BindEnv("default.agencies_amount", "AGENCIES_AMOUNT")
+	_ = v.BindEnv("default.agencies", "AGENCIES")
+	_ = v.BindEnv("default.agencies_keys_file", "AGENCIES_KEYS_FILE")
+	_ = v.BindEnv("default.server_tls_enabled", "SERVER_TLS_ENABLED")
+	_ = v.BindEnv("default.server_tls_cert", "SERVER_TLS_CERT")
+	_ = v.BindEnv("default.server_tls_key", "SERVER_TLS_KEY")
+	_ = v.BindEnv("default.server_tls_ca", "SERVER_TLS_CA")
+	_ = v.BindEnv("default.server_tls_require_client_cert", "SERVER_TLS_REQUIRE_CLIENT_CERT")
+	_ = v.BindEnv("default.storage_type", "STORAGE_TYPE")
+	_ = v.BindEnv("default.storage_path", "STORAGE_PATH")
+	_ = v.BindEnv("default.draw_seed_path", "DRAW_SEED_PATH")
+	_ = v.BindEnv("default.draw_record_path", "DRAW_RECORD_PATH")
+	_ = v.BindEnv("default.prize_tiers", "PRIZE_TIERS")
 	_ = v.BindEnv("default.logging_level", "LOGGING_LEVEL")
 
 	v.SetConfigFile("config.ini")
@@ -53,14 +68,63 @@ func initializeConfig() *Config {
 		log.Fatal("SERVER_LISTEN_BACKLOG is not set")
 	}
 
+	if iniData.Default.ServerMaxClients <= 0 {
+		log.Fatal("SERVER_MAX_CLIENTS must be a positive number")
+	}
+
+	if iniData.Default.ServerReadTimeout <= 0 || iniData.Default.ServerWriteTimeout <= 0 || iniData.Default.ServerIdleTimeout <= 0 {
+		log.Fatal("SERVER_READ_TIMEOUT, SERVER_WRITE_TIMEOUT and SERVER_IDLE_TIMEOUT must be positive durations")
+	}
+
+	agencies, err := common.ParseAgencies(iniData.Default.Agencies, iniData.Default.AgenciesAmount)
+	if err != nil {
+		log.Fatalf("AGENCIES or AGENCIES_AMOUNT must describe the expected agencies: %s", err)
+	}
+
+	// Finished agencies keep their session while waiting for the draw, with
+	// fewer slots than agencies the remaining ones could never finish
+	if iniData.Default.ServerMaxClients < len(agencies) {
+		log.Fatalf("SERVER_MAX_CLIENTS must be at least the amount of agencies, %d", len(agencies))
+	}
+
+	if iniData.Default.AgenciesKeysFile == "" {
+		log.Fatal("AGENCIES_KEYS_FILE is not set")
+	}
+
+	if iniData.Default.ServerTlsEnabled && (iniData.Default.ServerTlsCert == "" || iniData.Default.ServerTlsKey == "") {
+		log.Fatal("SERVER_TLS_CERT and SERVER_TLS_KEY must be set when SERVER_TLS_ENABLED is true")
+	}
+
+	if iniData.Default.ServerTlsRequireClientCert && (!iniData.Default.ServerTlsEnabled || iniData.Default.ServerTlsCa == "") {
+		log.Fatal("SERVER_TLS_REQUIRE_CLIENT_CERT needs SERVER_TLS_ENABLED and SERVER_TLS_CA")
+	}
+
+	switch iniData.Default.StorageType {
+	case common.StorageCSV, common.StorageLog:
+		if iniData.Default.StoragePath == "" {
+			log.Fatal("STORAGE_PATH is not set")
+		}
+	case common.StorageMemory:
+	default:
+		log.Fatalf("STORAGE_TYPE must be one of %s, %s or %s", common.StorageCSV, common.StorageLog, common.StorageMemory)
+	}
+
+	if iniData.Default.DrawSeedPath == "" || iniData.Default.DrawRecordPath == "" {
+		log.Fatal("DRAW_SEED_PATH and DRAW_RECORD_PATH must be set")
+	}
+
+	if _, err := common.ParsePrizeTiers(iniData.Default.PrizeTiers); err != nil {
+		log.Fatalf("PRIZE_TIERS must describe the prize table: %s", err)
+	}
+
 	return &iniData.Default
 }
 
 // PrintConfig Print all the configuration parameters of the program.
 // For debugging purposes only
-func PrintConfig(config *Config) {
+func PrintConfig(config *common.Config) {
 
-	log.Debugf("action: config | result: success | port: %d | listen_backlog: %d | logging_level: %s", config.ServerPort, config.ServerListenBacklog, config.LoggingLevel)
+	log.Debugf("action: config | result: success | ip: %s | port: %d | listen_backlog: %d | reuse_addr: %t | reuse_port: %t | max_clients: %d | read_timeout: %v | write_timeout: %v | idle_timeout: %v | agencies_amount: %d | agencies: %s | agencies_keys_file: %s | tls_enabled: %t | tls_cert: %s | tls_key: %s | tls_ca: %s | tls_require_client_cert: %t | storage_type: %s | storage_path: %s | draw_seed_path: %s | draw_record_path: %s | prize_tiers: %s | logging_level: %s", config.ServerIp, config.ServerPort, config.ServerListenBacklog, config.ServerReuseAddr, config.ServerReusePort, config.ServerMaxClients, config.ServerReadTimeout, config.ServerWriteTimeout, config.ServerIdleTimeout, config.AgenciesAmount, config.Agencies, config.AgenciesKeysFile, config.ServerTlsEnabled, config.ServerTlsCert, config.ServerTlsKey, config.ServerTlsCa, config.ServerTlsRequireClientCert, config.StorageType, config.StoragePath, config.DrawSeedPath, config.DrawRecordPath, config.PrizeTiers, config.LoggingLevel)
 }
 
 func main() {
@@ -72,10 +136,27 @@ func main() {
 
 	PrintConfig(env)
 
-	server, err := common.NewServer(env.ServerPort, env.ServerListenBacklog)
+	store, err := common.NewBetStore(afero.NewOsFs(), env.StorageType, env.StoragePath)
+	if err != nil {
+		log.Fatalf("Error opening bets store: %s", err)
+	}
+
+	server, err := common.NewServer(*env, store)
 	if err != nil {
-		log.Criticalf("Error creating server: %s", err)
+		log.Fatalf("Error creating server: %s", err)
 	}
 
+	stopSignals := shared.NotifyShutdown(func(sig os.Signal) {
+		log.Infof("action: signal_received | result: success | signal: %v", sig)
+		server.Shutdown()
+	})
+	defer stopSignals()
+
 	server.Run()
+
+	if err := store.Close(); err != nil {
+		log.Errorf("action: shutdown | result: fail | error: %s", err)
+		return
+	}
+	log.Info("action: shutdown | result: success")
 }
@@ -0,0 +1,130 @@
+// Package certs Creates a local certificate authority and issues the
+// certificates of the server and the agencies signed by it, so mutual TLS
+// can be set up without any external PKI
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Authority Certificate authority used to sign the issued certificates
+type Authority struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+}
+
+// NewAuthority Creates a self signed certificate authority valid for the
+// given duration
+func NewAuthority(name string, validity time.Duration) (*Authority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template, err := newTemplate(name, validity)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &Authority{cert: cert, key: key, certPEM: encodeCert(der)}, nil
+}
+
+// CertPEM Returns the PEM encoded certificate of the authority, to be
+// trusted by the peers
+func (a *Authority) CertPEM() []byte {
+	return a.certPEM
+}
+
+// KeyPEM Returns the PEM encoded private key of the authority
+func (a *Authority) KeyPEM() ([]byte, error) {
+	return encodeKey(a.key)
+}
+
+// IssueServer Issues a certificate for a server reachable at hosts, which
+// may be DNS names or IP addresses. Returns the PEM encoded certificate and
+// private key
+func (a *Authority) IssueServer(name string, hosts []string, validity time.Duration) ([]byte, []byte, error) {
+	return a.issue(name, hosts, x509.ExtKeyUsageServerAuth, validity)
+}
+
+// IssueClient Issues a client certificate whose common name identifies the
+// peer. Returns the PEM encoded certificate and private key
+func (a *Authority) IssueClient(name string, validity time.Duration) ([]byte, []byte, error) {
+	return a.issue(name, nil, x509.ExtKeyUsageClientAuth, validity)
+}
+
+func (a *Authority) issue(name string, hosts []string, usage x509.ExtKeyUsage, validity time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := newTemplate(name, validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encodeCert(der), keyPEM, nil
+}
+
+func newTemplate(name string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		// Tolerate small clock differences between the containers
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(validity),
+	}, nil
+}
+
+func encodeCert(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
@@ -0,0 +1,49 @@
+package shared
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+// ReplaceFile Replaces the file at path on fs with one holding data at
+// once: it is written aside, synced and renamed over it, so a crash leaves
+// either of them but never a partial file
+func ReplaceFile(fs afero.Fs, path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := writeSynced(fs, tmp, data, perm); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(fs, filepath.Dir(path))
+}
+
+// writeSynced Creates the file at path holding data, synced to disk
+func writeSynced(fs afero.Fs, path string, data []byte, perm os.FileMode) error {
+	file, err := fs.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncDir Flushes a directory so a rename inside it survives a crash
+func syncDir(fs afero.Fs, path string) error {
+	dir, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
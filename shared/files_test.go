@@ -0,0 +1,27 @@
+package shared
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplaceFileLeavesOnlyTheNewContent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	fs := afero.NewOsFs()
+
+	assert.Nil(t, ReplaceFile(fs, path, []byte("first\n"), 0600))
+	assert.Nil(t, ReplaceFile(fs, path, []byte("second\n"), 0600))
+
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "second\n", string(content))
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	_, err = os.Stat(path + ".tmp")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,45 @@
+package shared
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// LoadKeys Reads the secrets shared with each agency from a keys file.
+// Every row of the file holds an agency ID and its secret, separated by a
+// comma. Lines starting with # are ignored. The server holds the secret of
+// every agency while each agency only needs the row of its own
+func LoadKeys(path string) (map[string][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 2
+	reader.Comment = '#'
+
+	keys := make(map[string][]byte)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		agency, secret := strings.TrimSpace(record[0]), strings.TrimSpace(record[1])
+		if agency == "" || secret == "" {
+			return nil, fmt.Errorf("empty agency or secret in %s", path)
+		}
+		if _, ok := keys[agency]; ok {
+			return nil, fmt.Errorf("duplicated agency %s in %s", agency, path)
+		}
+		keys[agency] = []byte(secret)
+	}
+}
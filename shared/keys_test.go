@@ -0,0 +1,37 @@
+package shared
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeKeysFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "keys.csv")
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadKeysReadsSecretPerAgency(t *testing.T) {
+	path := writeKeysFile(t, "# agency,secret\n1,first secret\n2, second\n")
+
+	keys, err := LoadKeys(path)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]byte{
+		"1": []byte("first secret"),
+		"2": []byte("second"),
+	}, keys)
+}
+
+func TestLoadKeysRejectsDuplicatedAndEmptyRows(t *testing.T) {
+	_, err := LoadKeys(writeKeysFile(t, "1,a\n1,b\n"))
+	assert.NotNil(t, err)
+
+	_, err = LoadKeys(writeKeysFile(t, "1,\n"))
+	assert.NotNil(t, err)
+
+	_, err = LoadKeys(writeKeysFile(t, "1\n"))
+	assert.NotNil(t, err)
+}
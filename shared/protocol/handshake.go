@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+// ChallengeSize Length in bytes of the nonce sent in a challenge
+const ChallengeSize = 32
+
+// NewChallengeMessage Builds the reply to a hello carrying the nonce the
+// agency must sign
+func NewChallengeMessage(nonce []byte) (Message, error) {
+	if len(nonce) != ChallengeSize {
+		return Message{}, fmt.Errorf("invalid nonce size: %d", len(nonce))
+	}
+	w := payloadWriter{}
+	w.writeString(string(nonce))
+	payload, err := w.bytes()
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: MessageChallenge, Payload: payload}, nil
+}
+
+// DecodeChallenge Parses the payload of a MessageChallenge returning its
+// nonce
+func DecodeChallenge(msg Message) ([]byte, error) {
+	if msg.Type != MessageChallenge {
+		return nil, fmt.Errorf("unexpected message type: %v", msg.Type)
+	}
+	r := payloadReader{buf: msg.Payload}
+	nonce := r.readString()
+	if err := r.finish(); err != nil {
+		return nil, err
+	}
+	if len(nonce) != ChallengeSize {
+		return nil, ErrMalformed
+	}
+	return []byte(nonce), nil
+}
+
+// NewAuthMessage Builds the reply to a challenge holding its signature
+func NewAuthMessage(signature []byte) (Message, error) {
+	w := payloadWriter{}
+	w.writeString(string(signature))
+	payload, err := w.bytes()
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: MessageAuth, Payload: payload}, nil
+}
+
+// DecodeAuth Parses the payload of a MessageAuth returning its signature
+func DecodeAuth(msg Message) ([]byte, error) {
+	if msg.Type != MessageAuth {
+		return nil, fmt.Errorf("unexpected message type: %v", msg.Type)
+	}
+	r := payloadReader{buf: msg.Payload}
+	signature := r.readString()
+	if err := r.finish(); err != nil {
+		return nil, err
+	}
+	return []byte(signature), nil
+}
+
+// SignChallenge Computes the HMAC-SHA256 of the agency and the nonce keyed
+// by the agency secret. Signing the agency along with the nonce binds the
+// response to the agency that said hello
+func SignChallenge(secret []byte, agency string, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(agency))
+	mac.Write([]byte{0})
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// VerifyChallenge Reports whether signature is the response to the nonce
+// of the agency, comparing them in constant time
+func VerifyChallenge(secret []byte, agency string, nonce []byte, signature []byte) bool {
+	return hmac.Equal(SignChallenge(secret, agency, nonce), signature)
+}
@@ -0,0 +1,226 @@
+package protocol
+
+import "fmt"
+
+// maxReasonLength Error reasons longer than this are truncated
+const maxReasonLength = 1024
+
+// Bet Wire representation of a bet. Fields are kept as the strings read from
+// the agency so that parsing and validation stays on the server side
+type Bet struct {
+	Agency    string
+	FirstName string
+	LastName  string
+	Document  string
+	Birthdate string
+	Number    string
+}
+
+// betFields Amount of string fields encoded for every bet
+const betFields = 6
+
+// MaxBatchSize Upper bound for the encoded payload of a bets batch
+const MaxBatchSize = 8 * 1024
+
+// BetSize Returns how many bytes the bet takes inside a batch payload
+func BetSize(bet Bet) int {
+	return betFields*stringHeaderSize +
+		len(bet.Agency) +
+		len(bet.FirstName) +
+		len(bet.LastName) +
+		len(bet.Document) +
+		len(bet.Birthdate) +
+		len(bet.Number)
+}
+
+// BatchSize Returns the encoded payload size of a batch holding the bets:
+// its sequence number, the amount of bets and the bets themselves
+func BatchSize(bets []Bet) int {
+	size := 2 * uint32Size
+	for _, bet := range bets {
+		size += BetSize(bet)
+	}
+	return size
+}
+
+// NewBetBatchMessage Builds the message used by an agency to submit a batch
+// of bets. seq numbers the batches of the agency starting at 1, a batch
+// sent again keeps its number so the server can tell it was already
+// stored. The encoded batch must not exceed MaxBatchSize
+func NewBetBatchMessage(seq uint32, bets []Bet) (Message, error) {
+	if size := BatchSize(bets); size > MaxBatchSize {
+		return Message{}, fmt.Errorf("batch too large: %d bytes", size)
+	}
+	w := payloadWriter{}
+	w.writeUint32(seq)
+	w.writeUint32(uint32(len(bets)))
+	for _, bet := range bets {
+		w.writeString(bet.Agency)
+		w.writeString(bet.FirstName)
+		w.writeString(bet.LastName)
+		w.writeString(bet.Document)
+		w.writeString(bet.Birthdate)
+		w.writeString(bet.Number)
+	}
+	payload, err := w.bytes()
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: MessageBetBatch, Payload: payload}, nil
+}
+
+// DecodeBetBatch Parses the payload of a MessageBetBatch returning its
+// sequence number and bets
+func DecodeBetBatch(msg Message) (uint32, []Bet, error) {
+	if msg.Type != MessageBetBatch {
+		return 0, nil, fmt.Errorf("unexpected message type: %v", msg.Type)
+	}
+	r := payloadReader{buf: msg.Payload}
+	seq := r.readUint32()
+	count := int(r.readUint32())
+	if maxCount := len(msg.Payload) / (betFields * stringHeaderSize); count > maxCount {
+		return 0, nil, ErrMalformed
+	}
+	bets := make([]Bet, 0, count)
+	for i := 0; i < count; i++ {
+		bets = append(bets, Bet{
+			Agency:    r.readString(),
+			FirstName: r.readString(),
+			LastName:  r.readString(),
+			Document:  r.readString(),
+			Birthdate: r.readString(),
+			Number:    r.readString(),
+		})
+	}
+	if err := r.finish(); err != nil {
+		return 0, nil, err
+	}
+	return seq, bets, nil
+}
+
+// NewAckMessage Builds the message the server uses to confirm a request
+func NewAckMessage() Message {
+	return Message{Type: MessageAck}
+}
+
+// NewErrorMessage Builds the message the server uses to reject a request,
+// carrying a human readable reason
+func NewErrorMessage(reason string) Message {
+	w := payloadWriter{}
+	if len(reason) > maxReasonLength {
+		reason = reason[:maxReasonLength]
+	}
+	w.writeString(reason)
+	payload, _ := w.bytes()
+	return Message{Type: MessageError, Payload: payload}
+}
+
+// DecodeError Parses the payload of a MessageError returning its reason
+func DecodeError(msg Message) (string, error) {
+	if msg.Type != MessageError {
+		return "", fmt.Errorf("unexpected message type: %v", msg.Type)
+	}
+	r := payloadReader{buf: msg.Payload}
+	reason := r.readString()
+	if err := r.finish(); err != nil {
+		return "", err
+	}
+	return reason, nil
+}
+
+// NewHelloMessage Builds the message that opens a session on behalf of the
+// agency
+func NewHelloMessage(agency string) (Message, error) {
+	return newAgencyMessage(MessageHello, agency)
+}
+
+// NewGoodbyeMessage Builds the message that closes a session
+func NewGoodbyeMessage() Message {
+	return Message{Type: MessageGoodbye}
+}
+
+// NewBetsFinishedMessage Builds the message an agency uses to notify it has
+// no more bets to submit
+func NewBetsFinishedMessage(agency string) (Message, error) {
+	return newAgencyMessage(MessageBetsFinished, agency)
+}
+
+// NewWinnersQueryMessage Builds the message an agency uses to ask for its
+// winners
+func NewWinnersQueryMessage(agency string) (Message, error) {
+	return newAgencyMessage(MessageWinnersQuery, agency)
+}
+
+// DecodeAgency Parses the payload of the messages that only carry the
+// agency that sent them: MessageHello, MessageBetsFinished and
+// MessageWinnersQuery
+func DecodeAgency(msg Message) (string, error) {
+	if msg.Type != MessageHello && msg.Type != MessageBetsFinished && msg.Type != MessageWinnersQuery {
+		return "", fmt.Errorf("unexpected message type: %v", msg.Type)
+	}
+	r := payloadReader{buf: msg.Payload}
+	agency := r.readString()
+	if err := r.finish(); err != nil {
+		return "", err
+	}
+	return agency, nil
+}
+
+func newAgencyMessage(msgType MessageType, agency string) (Message, error) {
+	w := payloadWriter{}
+	w.writeString(agency)
+	payload, err := w.bytes()
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: msgType, Payload: payload}, nil
+}
+
+// Winner Winning bet of an agency along with the name of the prize tier
+// it won
+type Winner struct {
+	Document string
+	Tier     string
+}
+
+// NewWinnersMessage Builds the reply to a winners query holding the
+// winning bets of the agency
+func NewWinnersMessage(winners []Winner) (Message, error) {
+	w := payloadWriter{}
+	w.writeUint32(uint32(len(winners)))
+	for _, winner := range winners {
+		w.writeString(winner.Document)
+		w.writeString(winner.Tier)
+	}
+	payload, err := w.bytes()
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: MessageWinners, Payload: payload}, nil
+}
+
+// DecodeWinners Parses the payload of a MessageWinners
+func DecodeWinners(msg Message) ([]Winner, error) {
+	if msg.Type != MessageWinners {
+		return nil, fmt.Errorf("unexpected message type: %v", msg.Type)
+	}
+	r := payloadReader{buf: msg.Payload}
+	count := int(r.readUint32())
+	if maxCount := len(msg.Payload) / (2 * stringHeaderSize); count > maxCount {
+		return nil, ErrMalformed
+	}
+	winners := make([]Winner, 0, count)
+	for i := 0; i < count; i++ {
+		winners = append(winners, Winner{Document: r.readString(), Tier: r.readString()})
+	}
+	if err := r.finish(); err != nil {
+		return nil, err
+	}
+	return winners, nil
+}
+
+// NewDrawPendingMessage Builds the reply to a winners query received before
+// the draw took place
+func NewDrawPendingMessage() Message {
+	return Message{Type: MessageDrawPending}
+}
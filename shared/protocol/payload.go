@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+const (
+	stringHeaderSize = 2
+	uint8Size        = 1
+	uint32Size       = 4
+)
+
+// payloadWriter Builds a payload out of length prefixed fields. Strings are
+// written as a big endian uint16 length followed by their bytes, so any
+// content (newlines, commas, separators) is carried verbatim
+type payloadWriter struct {
+	buf []byte
+	err error
+}
+
+func (w *payloadWriter) writeString(s string) {
+	if w.err != nil {
+		return
+	}
+	if len(s) > math.MaxUint16 {
+		w.err = fmt.Errorf("field too long: %d bytes", len(s))
+		return
+	}
+	var length [stringHeaderSize]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(s)))
+	w.buf = append(w.buf, length[:]...)
+	w.buf = append(w.buf, s...)
+}
+
+func (w *payloadWriter) writeUint8(v uint8) {
+	if w.err != nil {
+		return
+	}
+	w.buf = append(w.buf, v)
+}
+
+func (w *payloadWriter) writeUint32(v uint32) {
+	if w.err != nil {
+		return
+	}
+	var value [uint32Size]byte
+	binary.BigEndian.PutUint32(value[:], v)
+	w.buf = append(w.buf, value[:]...)
+}
+
+func (w *payloadWriter) bytes() ([]byte, error) {
+	return w.buf, w.err
+}
+
+// payloadReader Consumes the fields written by a payloadWriter in the same
+// order. Any attempt to read past the end of the payload is reported as
+// ErrMalformed
+type payloadReader struct {
+	buf []byte
+	err error
+}
+
+func (r *payloadReader) readString() string {
+	if r.err != nil {
+		return ""
+	}
+	if len(r.buf) < stringHeaderSize {
+		r.err = ErrMalformed
+		return ""
+	}
+	length := int(binary.BigEndian.Uint16(r.buf))
+	r.buf = r.buf[stringHeaderSize:]
+	if len(r.buf) < length {
+		r.err = ErrMalformed
+		return ""
+	}
+	s := string(r.buf[:length])
+	r.buf = r.buf[length:]
+	return s
+}
+
+func (r *payloadReader) readUint8() uint8 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.buf) < uint8Size {
+		r.err = ErrMalformed
+		return 0
+	}
+	v := r.buf[0]
+	r.buf = r.buf[uint8Size:]
+	return v
+}
+
+func (r *payloadReader) readUint32() uint32 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.buf) < uint32Size {
+		r.err = ErrMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.buf)
+	r.buf = r.buf[uint32Size:]
+	return v
+}
+
+// finish Returns the first error found while reading, or ErrMalformed if
+// there are unread bytes left in the payload
+func (r *payloadReader) finish() error {
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.buf) != 0 {
+		return ErrMalformed
+	}
+	return nil
+}
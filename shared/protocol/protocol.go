@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// MessageType Identifies the kind of payload carried by a frame
+type MessageType byte
+
+const (
+	MessageBetBatch MessageType = iota + 1
+	MessageAck
+	MessageError
+	// MessageBetsFinished Sent by an agency once all its bets were submitted
+	MessageBetsFinished
+	// MessageWinnersQuery Sent by an agency to ask for its winners
+	MessageWinnersQuery
+	// MessageWinners Reply to a winners query holding the winning documents
+	// and the prize tier each of them won
+	MessageWinners
+	// MessageDrawPending Reply to a winners query when the draw has not
+	// taken place yet because some agencies are still submitting bets
+	MessageDrawPending
+	// MessageHello Opens a session, identifying the agency on the other end.
+	// The server answers it with a challenge the agency must sign
+	MessageHello
+	// MessageGoodbye Closes a session
+	MessageGoodbye
+	// MessageBetsRejected Reply to a bets batch when some of its bets were
+	// rejected, listing them with the reason. The rest of the batch was
+	// stored
+	MessageBetsRejected
+	// MessageChallenge Random nonce sent by the server in reply to a hello
+	MessageChallenge
+	// MessageAuth Reply to a challenge proving the agency knows its secret
+	MessageAuth
+
+	// lastMessageType Must be kept after every other message type
+	lastMessageType = MessageAuth
+)
+
+const (
+	// HeaderSize Every frame starts with a one byte message type followed
+	// by the payload length as a big endian uint32
+	HeaderSize = 5
+	// MaxPayloadSize Upper bound for a single payload, frames announcing a
+	// bigger payload are rejected before reading it
+	MaxPayloadSize = 1 << 20
+)
+
+var (
+	ErrPayloadTooLarge = errors.New("payload too large")
+	ErrUnknownMessage  = errors.New("unknown message type")
+	ErrMalformed       = errors.New("malformed payload")
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MessageBetBatch:
+		return "bet_batch"
+	case MessageAck:
+		return "ack"
+	case MessageError:
+		return "error"
+	case MessageBetsFinished:
+		return "bets_finished"
+	case MessageWinnersQuery:
+		return "winners_query"
+	case MessageWinners:
+		return "winners"
+	case MessageDrawPending:
+		return "draw_pending"
+	case MessageHello:
+		return "hello"
+	case MessageGoodbye:
+		return "goodbye"
+	case MessageBetsRejected:
+		return "bets_rejected"
+	case MessageChallenge:
+		return "challenge"
+	case MessageAuth:
+		return "auth"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(t))
+	}
+}
+
+func (t MessageType) valid() bool {
+	return t >= MessageBetBatch && t <= lastMessageType
+}
+
+// Message A single frame of the protocol: its type and the raw payload
+type Message struct {
+	Type    MessageType
+	Payload []byte
+}
+
+// Encode Serializes the message as header + payload so it can be sent in a
+// single write
+func (m Message) Encode() ([]byte, error) {
+	if len(m.Payload) > MaxPayloadSize {
+		return nil, ErrPayloadTooLarge
+	}
+	frame := make([]byte, HeaderSize+len(m.Payload))
+	frame[0] = byte(m.Type)
+	binary.BigEndian.PutUint32(frame[1:HeaderSize], uint32(len(m.Payload)))
+	copy(frame[HeaderSize:], m.Payload)
+	return frame, nil
+}
+
+// DecodeHeader Parses a frame header returning the message type and the
+// length of the payload that follows it
+func DecodeHeader(header []byte) (MessageType, int, error) {
+	if len(header) != HeaderSize {
+		return 0, 0, fmt.Errorf("invalid header size: %d", len(header))
+	}
+	msgType := MessageType(header[0])
+	if !msgType.valid() {
+		return 0, 0, ErrUnknownMessage
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > MaxPayloadSize {
+		return 0, 0, ErrPayloadTooLarge
+	}
+	return msgType, int(length), nil
+}
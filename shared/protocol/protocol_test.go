@@ -0,0 +1,197 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBetBatchMessageRoundTripKeepsFieldsAndOrder(t *testing.T) {
+	bets := []Bet{
+		{
+			Agency:    "1",
+			FirstName: "first,with\ncomma",
+			LastName:  "last\n",
+			Document:  "10000000",
+			Birthdate: "2000-12-20",
+			Number:    "7500",
+		},
+		{
+			Agency:    "1",
+			FirstName: "first_1",
+			LastName:  "last_1",
+			Document:  "10000001",
+			Birthdate: "2000-12-21",
+			Number:    "7501",
+		},
+	}
+	msg, err := NewBetBatchMessage(42, bets)
+	assert.Nil(t, err)
+	assert.Equal(t, BatchSize(bets), len(msg.Payload))
+
+	received := decodeFrame(t, msg)
+	assert.Equal(t, MessageBetBatch, received.Type)
+
+	seq, decoded, err := DecodeBetBatch(received)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(42), seq)
+	assert.Equal(t, bets, decoded)
+}
+
+func TestBetBatchMessageLargerThanMaxBatchSizeMustFail(t *testing.T) {
+	bets := make([]Bet, 0)
+	for BatchSize(bets) <= MaxBatchSize {
+		bets = append(bets, Bet{FirstName: "first", LastName: "last", Document: "10000000"})
+	}
+
+	_, err := NewBetBatchMessage(1, bets)
+	assert.NotNil(t, err)
+}
+
+func TestErrorMessageRoundTripKeepsReason(t *testing.T) {
+	received := decodeFrame(t, NewErrorMessage("first\nreason"))
+
+	reason, err := DecodeError(received)
+	assert.Nil(t, err)
+	assert.Equal(t, "first\nreason", reason)
+}
+
+func TestAckMessageHasEmptyPayload(t *testing.T) {
+	received := decodeFrame(t, NewAckMessage())
+
+	assert.Equal(t, MessageAck, received.Type)
+	assert.Empty(t, received.Payload)
+}
+
+func TestDecodeHeaderRejectsUnknownTypeAndHugePayloads(t *testing.T) {
+	_, _, err := DecodeHeader([]byte{0xff, 0, 0, 0, 0})
+	assert.ErrorIs(t, err, ErrUnknownMessage)
+
+	_, _, err = DecodeHeader([]byte{byte(MessageBetBatch), 0xff, 0xff, 0xff, 0xff})
+	assert.ErrorIs(t, err, ErrPayloadTooLarge)
+}
+
+func TestDecodeBetBatchWithMissingFieldsMustFail(t *testing.T) {
+	msg, err := NewBetBatchMessage(1, []Bet{{Agency: "1"}})
+	assert.Nil(t, err)
+	msg.Payload = msg.Payload[:len(msg.Payload)-1]
+
+	_, _, err = DecodeBetBatch(msg)
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestDecodeBetBatchWithOverstatedCountMustFail(t *testing.T) {
+	msg, err := NewBetBatchMessage(1, []Bet{{Agency: "1"}})
+	assert.Nil(t, err)
+	// The amount of bets follows the sequence number
+	msg.Payload[uint32Size] = 0xff
+
+	_, _, err = DecodeBetBatch(msg)
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+// decodeFrame Encodes the message and parses it back from the resulting frame
+func decodeFrame(t *testing.T, msg Message) Message {
+	frame, err := msg.Encode()
+	assert.Nil(t, err)
+
+	msgType, length, err := DecodeHeader(frame[:HeaderSize])
+	assert.Nil(t, err)
+	assert.Equal(t, len(frame)-HeaderSize, length)
+
+	return Message{Type: msgType, Payload: frame[HeaderSize:]}
+}
+
+func TestAgencyMessagesRoundTripKeepAgency(t *testing.T) {
+	finished, err := NewBetsFinishedMessage("3")
+	assert.Nil(t, err)
+	query, err := NewWinnersQueryMessage("4")
+	assert.Nil(t, err)
+	hello, err := NewHelloMessage("5")
+	assert.Nil(t, err)
+
+	agency, err := DecodeAgency(decodeFrame(t, finished))
+	assert.Nil(t, err)
+	assert.Equal(t, "3", agency)
+
+	agency, err = DecodeAgency(decodeFrame(t, query))
+	assert.Nil(t, err)
+	assert.Equal(t, "4", agency)
+
+	agency, err = DecodeAgency(decodeFrame(t, hello))
+	assert.Nil(t, err)
+	assert.Equal(t, "5", agency)
+}
+
+func TestWinnersMessageRoundTripKeepsDocumentsAndTiers(t *testing.T) {
+	winners := []Winner{
+		{Document: "30904465", Tier: "exact"},
+		{Document: "21689196", Tier: "last2"},
+	}
+	msg, err := NewWinnersMessage(winners)
+	assert.Nil(t, err)
+
+	decoded, err := DecodeWinners(decodeFrame(t, msg))
+	assert.Nil(t, err)
+	assert.Equal(t, winners, decoded)
+}
+
+func TestWinnersMessageWithoutWinnersIsEmpty(t *testing.T) {
+	msg, err := NewWinnersMessage(nil)
+	assert.Nil(t, err)
+
+	documents, err := DecodeWinners(decodeFrame(t, msg))
+	assert.Nil(t, err)
+	assert.Empty(t, documents)
+}
+
+func TestBetsRejectedMessageRoundTripKeepsRejections(t *testing.T) {
+	rejections := []Rejection{
+		{Index: 0, Reason: RejectUnderage},
+		{Index: 7, Reason: RejectInvalidNumber},
+	}
+	msg, err := NewBetsRejectedMessage(rejections)
+	assert.Nil(t, err)
+
+	decoded, err := DecodeBetsRejected(decodeFrame(t, msg))
+	assert.Nil(t, err)
+	assert.Equal(t, rejections, decoded)
+}
+
+func TestDecodeBetsRejectedWithUnknownReasonMustFail(t *testing.T) {
+	msg, err := NewBetsRejectedMessage([]Rejection{{Index: 0, Reason: lastRejectReason + 1}})
+	assert.Nil(t, err)
+
+	_, err = DecodeBetsRejected(msg)
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestHandshakeMessagesRoundTrip(t *testing.T) {
+	nonce := make([]byte, ChallengeSize)
+	for i := range nonce {
+		nonce[i] = byte(i)
+	}
+	msg, err := NewChallengeMessage(nonce)
+	assert.Nil(t, err)
+	decoded, err := DecodeChallenge(decodeFrame(t, msg))
+	assert.Nil(t, err)
+	assert.Equal(t, nonce, decoded)
+
+	signature := SignChallenge([]byte("secret"), "1", nonce)
+	msg, err = NewAuthMessage(signature)
+	assert.Nil(t, err)
+	received, err := DecodeAuth(decodeFrame(t, msg))
+	assert.Nil(t, err)
+	assert.True(t, VerifyChallenge([]byte("secret"), "1", nonce, received))
+}
+
+func TestVerifyChallengeRejectsOtherSecretsAgenciesAndNonces(t *testing.T) {
+	nonce := make([]byte, ChallengeSize)
+	signature := SignChallenge([]byte("secret"), "1", nonce)
+
+	assert.False(t, VerifyChallenge([]byte("other"), "1", nonce, signature))
+	assert.False(t, VerifyChallenge([]byte("secret"), "2", nonce, signature))
+	otherNonce := make([]byte, ChallengeSize)
+	otherNonce[0] = 1
+	assert.False(t, VerifyChallenge([]byte("secret"), "1", otherNonce, signature))
+}
@@ -0,0 +1,110 @@
+package protocol
+
+import "fmt"
+
+// RejectReason Code telling the agency why one of its bets was rejected
+type RejectReason byte
+
+const (
+	// RejectInvalidAgency The agency is not a number
+	RejectInvalidAgency RejectReason = iota + 1
+	// RejectAgencyMismatch The bet belongs to an agency other than the one
+	// that opened the session
+	RejectAgencyMismatch
+	// RejectInvalidName The first or last name is empty or too long
+	RejectInvalidName
+	// RejectInvalidDocument The document is not numeric or has a wrong
+	// length
+	RejectInvalidDocument
+	// RejectInvalidBirthdate The birthdate is not a YYYY-MM-DD date
+	RejectInvalidBirthdate
+	// RejectFutureBirthdate The birthdate is later than today
+	RejectFutureBirthdate
+	// RejectUnderage The bettor is not of age
+	RejectUnderage
+	// RejectInvalidNumber The number is not an integer between 0 and 9999
+	RejectInvalidNumber
+
+	// lastRejectReason Must be kept after every other reason
+	lastRejectReason = RejectInvalidNumber
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case RejectInvalidAgency:
+		return "invalid_agency"
+	case RejectAgencyMismatch:
+		return "agency_mismatch"
+	case RejectInvalidName:
+		return "invalid_name"
+	case RejectInvalidDocument:
+		return "invalid_document"
+	case RejectInvalidBirthdate:
+		return "invalid_birthdate"
+	case RejectFutureBirthdate:
+		return "future_birthdate"
+	case RejectUnderage:
+		return "underage"
+	case RejectInvalidNumber:
+		return "invalid_number"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(r))
+	}
+}
+
+func (r RejectReason) valid() bool {
+	return r >= RejectInvalidAgency && r <= lastRejectReason
+}
+
+// Rejection A bet rejected by the server, identified by its position in
+// the batch it was sent in
+type Rejection struct {
+	Index  int
+	Reason RejectReason
+}
+
+// rejectionSize Encoded size of a rejection: its index and reason
+const rejectionSize = uint32Size + uint8Size
+
+// NewBetsRejectedMessage Builds the reply to a bets batch in which some
+// bets were rejected
+func NewBetsRejectedMessage(rejections []Rejection) (Message, error) {
+	w := payloadWriter{}
+	w.writeUint32(uint32(len(rejections)))
+	for _, rejection := range rejections {
+		w.writeUint32(uint32(rejection.Index))
+		w.writeUint8(uint8(rejection.Reason))
+	}
+	payload, err := w.bytes()
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: MessageBetsRejected, Payload: payload}, nil
+}
+
+// DecodeBetsRejected Parses the payload of a MessageBetsRejected
+func DecodeBetsRejected(msg Message) ([]Rejection, error) {
+	if msg.Type != MessageBetsRejected {
+		return nil, fmt.Errorf("unexpected message type: %v", msg.Type)
+	}
+	r := payloadReader{buf: msg.Payload}
+	count := int(r.readUint32())
+	if maxCount := len(msg.Payload) / rejectionSize; count > maxCount {
+		return nil, ErrMalformed
+	}
+	rejections := make([]Rejection, 0, count)
+	for i := 0; i < count; i++ {
+		rejection := Rejection{
+			Index:  int(r.readUint32()),
+			Reason: RejectReason(r.readUint8()),
+		}
+		if r.err == nil && !rejection.Reason.valid() {
+			return nil, ErrMalformed
+		}
+		rejections = append(rejections, rejection)
+	}
+	if err := r.finish(); err != nil {
+		return nil, err
+	}
+	return rejections, nil
+}
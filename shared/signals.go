@@ -0,0 +1,33 @@
+package shared
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// NotifyShutdown Listens for SIGTERM and SIGINT and calls shutdown, in its
+// own goroutine, the first time one of them is received. The returned
+// function stops listening for signals
+func NotifyShutdown(shutdown func(os.Signal)) func() {
+	signals := make(chan os.Signal, 1)
+	stopped := make(chan struct{})
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			shutdown(sig)
+		case <-stopped:
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		select {
+		case <-stopped:
+		default:
+			close(stopped)
+		}
+	}
+}
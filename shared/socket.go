@@ -0,0 +1,149 @@
+package shared
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared/protocol"
+)
+
+// ErrIdleTimeout Returned by AwaitMessage when no message started to
+// arrive before the idle timeout expired
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// WriteAll Writes the whole buffer to w, retrying after short writes until
+// every byte has been written or an error occurs
+func WriteAll(w io.Writer, data []byte) error {
+	for len(data) > 0 {
+		n, err := w.Write(data)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// ReadExact Reads exactly n bytes from r, retrying after short reads. If the
+// stream ends before n bytes are received an error is returned and the
+// partial data is discarded
+func ReadExact(r io.Reader, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	read := 0
+	for read < n {
+		m, err := r.Read(buf[read:])
+		read += m
+		if read == n {
+			break
+		}
+		if errors.Is(err, io.EOF) {
+			if read == 0 {
+				return nil, io.EOF
+			}
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// SendMessage Writes a whole protocol frame to the connection. The write
+// must complete before timeout expires, a zero timeout disables it
+func SendMessage(conn net.Conn, msg protocol.Message, timeout time.Duration) error {
+	frame, err := msg.Encode()
+	if err != nil {
+		return err
+	}
+	if err := conn.SetWriteDeadline(deadline(timeout)); err != nil {
+		return err
+	}
+	return WriteAll(conn, frame)
+}
+
+// ReceiveMessage Reads a whole protocol frame from the connection. The
+// message is only returned once header and payload have been completely
+// received before timeout expires, a zero timeout disables it
+func ReceiveMessage(conn net.Conn, timeout time.Duration) (protocol.Message, error) {
+	if err := conn.SetReadDeadline(deadline(timeout)); err != nil {
+		return protocol.Message{}, err
+	}
+	return receiveFrame(conn, nil)
+}
+
+// AwaitMessage Waits up to idle for the next message to start arriving and
+// then up to read for the rest of its frame. ErrIdleTimeout is returned if
+// not a single byte arrived while idle, so a silent peer can be told apart
+// from one that stalls halfway through a frame
+func AwaitMessage(conn net.Conn, idle time.Duration, read time.Duration) (protocol.Message, error) {
+	if err := conn.SetReadDeadline(deadline(idle)); err != nil {
+		return protocol.Message{}, err
+	}
+	first, err := ReadExact(conn, 1)
+	if IsTimeout(err) {
+		return protocol.Message{}, ErrIdleTimeout
+	}
+	if err != nil {
+		return protocol.Message{}, err
+	}
+
+	if err := conn.SetReadDeadline(deadline(read)); err != nil {
+		return protocol.Message{}, err
+	}
+	return receiveFrame(conn, first)
+}
+
+// receiveFrame Reads the rest of a frame whose first bytes, if any, were
+// already read into prefix
+func receiveFrame(conn net.Conn, prefix []byte) (protocol.Message, error) {
+	rest, err := ReadExact(conn, protocol.HeaderSize-len(prefix))
+	if err != nil {
+		if errors.Is(err, io.EOF) && len(prefix) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return protocol.Message{}, err
+	}
+	msgType, length, err := protocol.DecodeHeader(append(prefix, rest...))
+	if err != nil {
+		return protocol.Message{}, err
+	}
+	payload, err := ReadExact(conn, length)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return protocol.Message{}, err
+	}
+	return protocol.Message{Type: msgType, Payload: payload}, nil
+}
+
+// IsTimeout Reports whether a socket operation failed because its deadline
+// expired
+func IsTimeout(err error) bool {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// IsReset Reports whether a socket operation failed because the peer
+// abruptly closed the connection
+func IsReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
@@ -0,0 +1,188 @@
+package shared
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared/protocol"
+)
+
+// fragmentedWriter Writes at most chunk bytes per call, pausing between
+// writes so the reader observes the data arriving in pieces
+type fragmentedWriter struct {
+	w     io.Writer
+	chunk int
+	pause time.Duration
+}
+
+func (f *fragmentedWriter) Write(p []byte) (int, error) {
+	if len(p) > f.chunk {
+		p = p[:f.chunk]
+	}
+	time.Sleep(f.pause)
+	return f.w.Write(p)
+}
+
+func testBetMessage(t *testing.T) protocol.Message {
+	msg, err := protocol.NewBetBatchMessage(1, []protocol.Bet{{
+		Agency:    "1",
+		FirstName: "first",
+		LastName:  "last",
+		Document:  "10000000",
+		Birthdate: "2000-12-20",
+		Number:    "7500",
+	}})
+	assert.Nil(t, err)
+	return msg
+}
+
+func TestWriteAllRetriesShortWrites(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	msg := testBetMessage(t)
+	frame, err := msg.Encode()
+	assert.Nil(t, err)
+
+	go func() {
+		assert.Nil(t, WriteAll(&fragmentedWriter{w: client, chunk: 1}, frame))
+	}()
+
+	received, err := ReceiveMessage(server, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, received)
+}
+
+func TestReceiveMessageWaitsForWholeFrame(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	msg := testBetMessage(t)
+	frame, err := msg.Encode()
+	assert.Nil(t, err)
+
+	go func() {
+		WriteAll(&fragmentedWriter{w: client, chunk: 3, pause: time.Millisecond}, frame)
+	}()
+
+	received, err := ReceiveMessage(server, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, received)
+}
+
+func TestReceiveMessageWithTruncatedFrameMustFail(t *testing.T) {
+	msg := testBetMessage(t)
+	frame, err := msg.Encode()
+	assert.Nil(t, err)
+
+	for cut := 1; cut < len(frame); cut++ {
+		client, server := net.Pipe()
+		go func() {
+			WriteAll(&fragmentedWriter{w: client, chunk: 2}, frame[:cut])
+			client.Close()
+		}()
+
+		received, err := ReceiveMessage(server, time.Second)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF, "cut at %d", cut)
+		assert.Equal(t, protocol.Message{}, received)
+		server.Close()
+	}
+}
+
+func TestReceiveMessageOnClosedConnectionReturnsEOF(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+	client.Close()
+
+	server, err := listener.Accept()
+	assert.Nil(t, err)
+	defer server.Close()
+
+	_, err = ReceiveMessage(server, time.Second)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestReceiveMessageMustTimeoutWhenPeerIsSilent(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	_, err := ReceiveMessage(server, 10*time.Millisecond)
+
+	var netErr net.Error
+	assert.True(t, errors.As(err, &netErr))
+	assert.True(t, netErr.Timeout())
+}
+
+func TestSendMessageMustTimeoutWhenPeerDoesNotRead(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	err := SendMessage(client, testBetMessage(t), 10*time.Millisecond)
+
+	var netErr net.Error
+	assert.True(t, errors.As(err, &netErr))
+	assert.True(t, netErr.Timeout())
+}
+
+func TestAwaitMessageTellsSilentPeersFromStalledFrames(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	_, err := AwaitMessage(server, 10*time.Millisecond, time.Second)
+	assert.ErrorIs(t, err, ErrIdleTimeout)
+
+	frame, err := testBetMessage(t).Encode()
+	assert.Nil(t, err)
+	go WriteAll(client, frame[:protocol.HeaderSize+1])
+
+	_, err = AwaitMessage(server, time.Second, 10*time.Millisecond)
+	assert.NotErrorIs(t, err, ErrIdleTimeout)
+	assert.True(t, IsTimeout(err))
+}
+
+func TestAwaitMessageReceivesWholeFrame(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	msg := testBetMessage(t)
+	go SendMessage(client, msg, time.Second)
+
+	received, err := AwaitMessage(server, time.Second, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, received)
+}
+
+func TestIsResetOnConnectionClosedByPeer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+
+	server, err := listener.Accept()
+	assert.Nil(t, err)
+	// A zero linger makes close send a RST instead of a FIN
+	assert.Nil(t, server.(*net.TCPConn).SetLinger(0))
+	server.Close()
+
+	_, err = ReceiveMessage(client, time.Second)
+	assert.True(t, IsReset(err), "got %v", err)
+	assert.False(t, IsTimeout(err))
+}